@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/firefart/zwiebelproxy/internal/helper"
+	"gopkg.in/yaml.v3"
+)
+
+// loadConfigFile sets all flags that were not passed on the command line to
+// the values of the YAML file at path. The keys of the file are the flag names.
+func loadConfigFile(fs *flag.FlagSet, path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var values map[string]yaml.Node
+	if err := yaml.Unmarshal(content, &values); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	for key, node := range values {
+		f := fs.Lookup(key)
+		if f == nil || key == "config" {
+			return fmt.Errorf("unknown config key %s", key)
+		}
+		// flags passed on the command line take precedence
+		if explicit[key] {
+			continue
+		}
+		value, err := configValue(node)
+		if err != nil {
+			return fmt.Errorf("invalid value for config key %s: %w", key, err)
+		}
+		if err := f.Value.Set(value); err != nil {
+			return fmt.Errorf("invalid value for config key %s: %w", key, err)
+		}
+	}
+
+	if fs.Lookup("domain").Value.String() == "" {
+		return fmt.Errorf("missing config key domain")
+	}
+	for _, x := range helper.DeleteEmptyItems(strings.Split(fs.Lookup("allowed-ip-ranges").Value.String(), ",")) {
+		if _, err := netip.ParsePrefix(x); err != nil {
+			return fmt.Errorf("invalid value for config key allowed-ip-ranges: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// configValue converts a YAML value to the string representation of the flag.
+// Sequences are joined by comma like the list options on the command line.
+func configValue(node yaml.Node) (string, error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return node.Value, nil
+	case yaml.SequenceNode:
+		items := make([]string, 0, len(node.Content))
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return "", fmt.Errorf("line %d: nested values are not supported", item.Line)
+			}
+			items = append(items, item.Value)
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", fmt.Errorf("line %d: nested values are not supported", node.Line)
+	}
+}
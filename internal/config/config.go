@@ -0,0 +1,92 @@
+package config
+
+import (
+	"log/slog"
+	"net/netip"
+	"regexp"
+	"time"
+
+	"github.com/firefart/zwiebelproxy/internal/dns"
+)
+
+type Config struct {
+	Domain               string
+	ValidateOnions       bool
+	BlockedOnions        []string
+	TorProxy             string
+	Debug                bool
+	EnablePprof          bool
+	EnableMetrics        bool
+	Cloudflare           bool
+	RevProxy             bool
+	TrustForwarded       bool
+	BlacklistedWords     string
+	BlacklistTypes       []string
+	BlacklistURL         string
+	BlacklistRefresh     time.Duration
+	StripHeaders         []string
+	PreserveHeaders      []string
+	ProxyErrorMarkers    []string
+	RewriteQuery         bool
+	RewriteRequestBody   bool
+	NoRewritePlaintext   bool
+	KeepChunked          bool
+	RecompressWorkers    int
+	RelativizeSameHost   bool
+	StripMethodOverride  bool
+	FixMixedContent      bool
+	RewriteRedirects     bool
+	CollapseSlashes      bool
+	RegenerateDate       bool
+	DropEarlyHints       bool
+	IsolateRequests      bool
+	UpgradeInsecure      string
+	SecFetch             string
+	Referer              string
+	ETagPolicy           string
+	ServerHeader         string
+	ExposeOnionHost      bool
+	PortSchemes          map[string]string
+	LandingTemplate      string
+	LandingAccess        string
+	ErrorTemplate        string
+	PageCSS              string
+	AllowFraming         bool
+	SecretKeyHeaderName  string
+	SecretKeyHeaderValue string
+	BypassHeaderName     string
+	BypassHeaderValue    string
+	Timeout              time.Duration
+	RequestDeadline      time.Duration
+	ResponseJitter       time.Duration
+	DrainGrace           time.Duration
+	RetryStatuses        []int
+	RetryMax             int
+	UpstreamRetries      int
+	MaxRequestBody       string
+	MaxConnsPerIP        int
+	ShedErrorPercent     int
+	ShedMinRequests      int
+	ShedWindow           time.Duration
+	ShedCooldown         time.Duration
+	DNSCacheTimeout      time.Duration
+	DNSCacheMaxEntries   int
+	DNSNegativeTimeout   time.Duration
+	AllowedHosts         []string
+	MaxHostLookups       int
+	RevalidateOnDeny     bool
+	BlockedAgents        []*regexp.Regexp
+	AllowedIPs           []string
+	AllowedIPRanges      []netip.Prefix
+	AdminIPRanges        []netip.Prefix
+	TrustedProxyRanges   []netip.Prefix
+
+	// AuditLogger receives all denied requests. If nil they are only logged to the default logger
+	AuditLogger *slog.Logger
+
+	// Resolver is used to resolve the allowed hosts. If nil the system resolver is used
+	Resolver dns.Resolver
+
+	// OnDrained is called after the drain grace period to shut down the server
+	OnDrained func()
+}
@@ -1,33 +1,87 @@
 package dns
 
 import (
+	"container/list"
 	"context"
+	"errors"
+	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/patrickmn/go-cache"
 )
 
+// Resolver resolves host names to ip addresses. It is implemented by
+// net.Resolver and can be used to plug in resolvers like DNS over HTTPS.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// ErrCachedFailure is returned if a previous lookup of the domain failed and
+// the failure is still cached. It wraps the error of the failed lookup.
+var ErrCachedFailure = errors.New("cached lookup failure")
+
 type DnsClient struct {
-	cache    *cache.Cache
-	resolver *net.Resolver
-	timeout  time.Duration
+	cache      *cache.Cache
+	resolver   Resolver
+	timeout    time.Duration
+	maxEntries int
+	// negative caches failed lookups, nil if they are not cached
+	negative *cache.Cache
+	// lru keeps track of the cache keys in order of their usage,
+	// the most recently used entry is at the front
+	lru      *list.List
+	lruItems map[string]*list.Element
+	lruMutex sync.Mutex
+	// revalidations of the cache are limited to one per revalidateInterval
+	revalidateInterval time.Duration
+	lastRevalidate     atomic.Int64
 }
 
-func NewDNSClient(timeout, dnsCacheTimeout time.Duration) *DnsClient {
-	var r *net.Resolver
+// defaultRevalidateInterval is the minimum time between two cache revalidations
+const defaultRevalidateInterval = 30 * time.Second
+
+// NewDNSClient creates a new caching dns client. If maxEntries is greater than 0
+// the least recently used entries are evicted once the cache is full. Failed
+// lookups are cached for negativeCacheTimeout, 0 disables the negative cache.
+// If resolver is nil the default resolver of the system is used.
+func NewDNSClient(timeout, dnsCacheTimeout, negativeCacheTimeout time.Duration, maxEntries int, resolver Resolver) *DnsClient {
+	r := resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+
+	var negative *cache.Cache
+	if negativeCacheTimeout > 0 {
+		negative = cache.New(negativeCacheTimeout, 1*time.Hour)
+	}
 
 	return &DnsClient{
-		cache:    cache.New(dnsCacheTimeout, 1*time.Hour),
-		resolver: r,
-		timeout:  timeout,
+		cache:      cache.New(dnsCacheTimeout, 1*time.Hour),
+		negative:   negative,
+		resolver:   r,
+		timeout:    timeout,
+		maxEntries: maxEntries,
+		lru:        list.New(),
+		lruItems:   make(map[string]*list.Element),
+
+		revalidateInterval: defaultRevalidateInterval,
 	}
 }
 
 func (d *DnsClient) IPLookup(ctx context.Context, domain string) ([]string, error) {
-	val, found := d.cache.Get(domain)
+	val, found := d.get(domain)
 	if found {
-		return val.([]string), nil
+		return val, nil
+	}
+
+	// an unresolvable host would otherwise be looked up on every request
+	if d.negative != nil {
+		if cached, found := d.negative.Get(domain); found {
+			return nil, fmt.Errorf("%w: %w", ErrCachedFailure, cached.(error))
+		}
 	}
 
 	ctx2, cancel := context.WithTimeout(ctx, d.timeout)
@@ -35,10 +89,159 @@ func (d *DnsClient) IPLookup(ctx context.Context, domain string) ([]string, erro
 
 	addr, err := d.resolver.LookupHost(ctx2, domain)
 	if err != nil {
+		// lookups canceled by the caller did not fail
+		if d.negative != nil && ctx.Err() == nil {
+			d.negative.Set(domain, err, cache.DefaultExpiration)
+		}
 		return nil, err
 	}
 
-	d.cache.Set(domain, addr, cache.DefaultExpiration)
+	d.set(domain, addr)
 
 	return addr, nil
 }
+
+// MatchIP resolves the domains in parallel with at most concurrency lookups
+// at a time and returns the first domain resolving to ip. Remaining lookups
+// are canceled after a match. An empty string is returned if no domain
+// matches, the error is only set if no domain matched.
+func (d *DnsClient) MatchIP(ctx context.Context, domains []string, ip string, concurrency int) (string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		match    string
+		firstErr error
+	)
+	for _, domain := range domains {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		// stop starting new lookups after a match
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			addrs, err := d.IPLookup(ctx, domain)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil && ctx.Err() == nil {
+					firstErr = fmt.Errorf("could not resolve %s: %w", domain, err)
+				}
+				return
+			}
+			for _, addr := range addrs {
+				if addr == ip && match == "" {
+					match = domain
+					cancel()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if match != "" {
+		return match, nil
+	}
+	// the parent context might be canceled
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
+	return "", firstErr
+}
+
+// RevalidateIP purges the cached entries of the domains and matches the ip
+// again like MatchIP. This allows clients behind dynamic dns hosts to connect
+// right after an ip change. To not flood the resolver only one revalidation
+// per interval is done, ok is false if the revalidation was skipped.
+func (d *DnsClient) RevalidateIP(ctx context.Context, domains []string, ip string, concurrency int) (match string, ok bool, err error) {
+	now := time.Now().UnixNano()
+	last := d.lastRevalidate.Load()
+	if last != 0 && now-last < d.revalidateInterval.Nanoseconds() {
+		return "", false, nil
+	}
+	if !d.lastRevalidate.CompareAndSwap(last, now) {
+		// another request is already revalidating
+		return "", false, nil
+	}
+
+	for _, domain := range domains {
+		d.delete(domain)
+	}
+	match, err = d.MatchIP(ctx, domains, ip, concurrency)
+	return match, true, err
+}
+
+func (d *DnsClient) get(domain string) ([]string, bool) {
+	val, found := d.cache.Get(domain)
+	if !found {
+		return nil, false
+	}
+
+	if d.maxEntries > 0 {
+		d.lruMutex.Lock()
+		if e, ok := d.lruItems[domain]; ok {
+			d.lru.MoveToFront(e)
+		}
+		d.lruMutex.Unlock()
+	}
+
+	return val.([]string), true
+}
+
+func (d *DnsClient) delete(domain string) {
+	d.cache.Delete(domain)
+	if d.negative != nil {
+		d.negative.Delete(domain)
+	}
+
+	if d.maxEntries <= 0 {
+		return
+	}
+
+	d.lruMutex.Lock()
+	defer d.lruMutex.Unlock()
+	if e, ok := d.lruItems[domain]; ok {
+		d.lru.Remove(e)
+		delete(d.lruItems, domain)
+	}
+}
+
+func (d *DnsClient) set(domain string, addr []string) {
+	d.cache.Set(domain, addr, cache.DefaultExpiration)
+
+	if d.maxEntries <= 0 {
+		return
+	}
+
+	d.lruMutex.Lock()
+	defer d.lruMutex.Unlock()
+
+	if e, ok := d.lruItems[domain]; ok {
+		d.lru.MoveToFront(e)
+		return
+	}
+
+	d.lruItems[domain] = d.lru.PushFront(domain)
+	for d.lru.Len() > d.maxEntries {
+		oldest := d.lru.Back()
+		key := oldest.Value.(string)
+		d.lru.Remove(oldest)
+		delete(d.lruItems, key)
+		d.cache.Delete(key)
+	}
+}
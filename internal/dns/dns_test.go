@@ -0,0 +1,226 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// resolverFunc adapts a function to the Resolver interface
+type resolverFunc func(ctx context.Context, host string) ([]string, error)
+
+func (f resolverFunc) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return f(ctx, host)
+}
+
+func TestCacheEviction(t *testing.T) {
+	t.Parallel()
+
+	d := NewDNSClient(1*time.Minute, 1*time.Minute, 0, 2, nil)
+	d.set("a.com", []string{"1.1.1.1"})
+	d.set("b.com", []string{"2.2.2.2"})
+
+	// access a.com so b.com is the least recently used entry
+	_, found := d.get("a.com")
+	assert.True(t, found)
+
+	d.set("c.com", []string{"3.3.3.3"})
+
+	_, found = d.get("b.com")
+	assert.False(t, found)
+	val, found := d.get("a.com")
+	assert.True(t, found)
+	assert.Equal(t, []string{"1.1.1.1"}, val)
+	val, found = d.get("c.com")
+	assert.True(t, found)
+	assert.Equal(t, []string{"3.3.3.3"}, val)
+	assert.Equal(t, 2, d.cache.ItemCount())
+}
+
+func TestCacheUnbounded(t *testing.T) {
+	t.Parallel()
+
+	d := NewDNSClient(1*time.Minute, 1*time.Minute, 0, 0, nil)
+	d.set("a.com", []string{"1.1.1.1"})
+	d.set("b.com", []string{"2.2.2.2"})
+	d.set("c.com", []string{"3.3.3.3"})
+	assert.Equal(t, 3, d.cache.ItemCount())
+	assert.Equal(t, 0, d.lru.Len())
+}
+
+func TestMatchIP(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		domains     []string
+		ip          string
+		expected    string
+		expectError bool
+	}{
+		{"match at end", []string{"a.com", "b.com", "c.com", "d.com", "e.com", "f.com", "g.com", "h.com", "i.com", "match.com"}, "192.0.2.1", "match.com", false},
+		{"no match", []string{"a.com", "b.com", "c.com"}, "192.0.2.1", "", false},
+		{"error without match", []string{"a.com", "error.com"}, "192.0.2.1", "", true},
+		{"error with match", []string{"error.com", "match.com"}, "192.0.2.1", "match.com", false},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			const concurrency = 3
+			var running, maxRunning atomic.Int64
+			d := NewDNSClient(1*time.Minute, 1*time.Minute, 0, 0, nil)
+			d.resolver = resolverFunc(func(ctx context.Context, host string) ([]string, error) {
+				n := running.Add(1)
+				defer running.Add(-1)
+				for {
+					m := maxRunning.Load()
+					if n <= m || maxRunning.CompareAndSwap(m, n) {
+						break
+					}
+				}
+				time.Sleep(20 * time.Millisecond)
+				switch host {
+				case "match.com":
+					return []string{"198.51.100.1", "192.0.2.1"}, nil
+				case "error.com":
+					return nil, errors.New("no such host")
+				default:
+					return []string{"198.51.100.1"}, nil
+				}
+			})
+
+			match, err := d.MatchIP(context.Background(), tt.domains, tt.ip, concurrency)
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tt.expected, match)
+			require.LessOrEqual(t, maxRunning.Load(), int64(concurrency))
+			// the lookups run in parallel
+			if len(tt.domains) > concurrency {
+				require.Equal(t, int64(concurrency), maxRunning.Load())
+			}
+		})
+	}
+}
+
+func TestRevalidateIP(t *testing.T) {
+	t.Parallel()
+
+	var currentIP atomic.Value
+	currentIP.Store("192.0.2.1")
+	var lookups atomic.Int64
+	d := NewDNSClient(1*time.Minute, 1*time.Minute, 0, 10, nil)
+	d.resolver = resolverFunc(func(ctx context.Context, host string) ([]string, error) {
+		lookups.Add(1)
+		return []string{currentIP.Load().(string)}, nil
+	})
+
+	match, err := d.MatchIP(context.Background(), []string{"dyn.example.com"}, "192.0.2.1", 1)
+	require.NoError(t, err)
+	require.Equal(t, "dyn.example.com", match)
+
+	// the client got a new ip but the old one is still cached
+	currentIP.Store("192.0.2.2")
+	match, err = d.MatchIP(context.Background(), []string{"dyn.example.com"}, "192.0.2.2", 1)
+	require.NoError(t, err)
+	require.Empty(t, match)
+	require.Equal(t, int64(1), lookups.Load())
+
+	match, ok, err := d.RevalidateIP(context.Background(), []string{"dyn.example.com"}, "192.0.2.2", 1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "dyn.example.com", match)
+	require.Equal(t, int64(2), lookups.Load())
+
+	// the new ip is cached
+	match, err = d.MatchIP(context.Background(), []string{"dyn.example.com"}, "192.0.2.2", 1)
+	require.NoError(t, err)
+	require.Equal(t, "dyn.example.com", match)
+	require.Equal(t, int64(2), lookups.Load())
+
+	// revalidations are rate limited
+	match, ok, err = d.RevalidateIP(context.Background(), []string{"dyn.example.com"}, "192.0.2.3", 1)
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.Empty(t, match)
+	require.Equal(t, int64(2), lookups.Load())
+}
+
+func TestNegativeCache(t *testing.T) {
+	t.Parallel()
+
+	lookupErr := &net.DNSError{Err: "no such host", Name: "dyn.example.com", IsNotFound: true}
+	var lookups atomic.Int64
+	d := NewDNSClient(1*time.Minute, 1*time.Minute, 50*time.Millisecond, 10, nil)
+	d.resolver = resolverFunc(func(ctx context.Context, host string) ([]string, error) {
+		lookups.Add(1)
+		return nil, lookupErr
+	})
+
+	// cache miss
+	_, err := d.IPLookup(context.Background(), "dyn.example.com")
+	require.ErrorIs(t, err, lookupErr)
+	require.NotErrorIs(t, err, ErrCachedFailure)
+	require.Equal(t, int64(1), lookups.Load())
+
+	// the failure is served from the cache
+	_, err = d.IPLookup(context.Background(), "dyn.example.com")
+	require.ErrorIs(t, err, ErrCachedFailure)
+	require.ErrorIs(t, err, lookupErr)
+	require.Equal(t, int64(1), lookups.Load())
+
+	// the host is looked up again after the negative cache timeout
+	require.Eventually(t, func() bool {
+		_, err := d.IPLookup(context.Background(), "dyn.example.com")
+		return !errors.Is(err, ErrCachedFailure)
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, int64(2), lookups.Load())
+}
+
+func TestNegativeCacheCanceled(t *testing.T) {
+	t.Parallel()
+
+	var lookups atomic.Int64
+	d := NewDNSClient(1*time.Minute, 1*time.Minute, 1*time.Minute, 10, nil)
+	d.resolver = resolverFunc(func(ctx context.Context, host string) ([]string, error) {
+		lookups.Add(1)
+		return nil, ctx.Err()
+	})
+
+	// lookups canceled by the caller are not cached
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := d.IPLookup(ctx, "dyn.example.com")
+	require.ErrorIs(t, err, context.Canceled)
+	_, err = d.IPLookup(ctx, "dyn.example.com")
+	require.NotErrorIs(t, err, ErrCachedFailure)
+	require.Equal(t, int64(2), lookups.Load())
+}
+
+func TestNegativeCacheDisabled(t *testing.T) {
+	t.Parallel()
+
+	var lookups atomic.Int64
+	d := NewDNSClient(1*time.Minute, 1*time.Minute, 0, 10, nil)
+	d.resolver = resolverFunc(func(ctx context.Context, host string) ([]string, error) {
+		lookups.Add(1)
+		return nil, errors.New("lookup failed")
+	})
+
+	for range 2 {
+		_, err := d.IPLookup(context.Background(), "dyn.example.com")
+		require.Error(t, err)
+		require.NotErrorIs(t, err, ErrCachedFailure)
+	}
+	require.Equal(t, int64(2), lookups.Load())
+}
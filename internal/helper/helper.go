@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
 )
 
 var letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
@@ -41,6 +42,17 @@ func LookupEnvOrBool(key string, defaultVal bool) bool {
 	return defaultVal
 }
 
+func LookupEnvOrInt(key string, defaultVal int) int {
+	if val, ok := os.LookupEnv(key); ok {
+		v, err := strconv.Atoi(val)
+		if err != nil {
+			return defaultVal
+		}
+		return v
+	}
+	return defaultVal
+}
+
 func LookupEnvOrDuration(key string, defaultVal time.Duration) time.Duration {
 	if val, ok := os.LookupEnv(key); ok {
 		v, err := time.ParseDuration(val)
@@ -127,6 +139,29 @@ func BrotliInput(data []byte) ([]byte, error) {
 	return b.Bytes(), nil
 }
 
+func ZstdInput(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	z, err := zstd.NewWriter(&b)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = z.Write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = z.Flush(); err != nil {
+		return nil, err
+	}
+
+	if err = z.Close(); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
 func DeleteEmptyItems(s []string) []string {
 	var r []string
 	for _, str := range s {
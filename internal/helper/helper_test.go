@@ -99,6 +99,36 @@ func TestLookupEnvOrBool(t *testing.T) {
 	}
 }
 
+func TestLookupEnvOrInt(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		setEnv       bool
+		value        string
+		defaultValue int
+		expected     int
+	}{
+		{setEnv: true, value: "invalid", defaultValue: 10, expected: 10},
+		{setEnv: true, value: "100", defaultValue: 10, expected: 100},
+		{setEnv: true, value: "-1", defaultValue: 10, expected: -1},
+		{setEnv: false, value: "", defaultValue: 10, expected: 10},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run("", func(t *testing.T) {
+			t.Parallel() // marks each test case as capable of running in parallel with each other
+
+			envName := RandString(10)
+
+			if tt.setEnv {
+				os.Setenv(envName, tt.value)
+				defer os.Unsetenv(envName)
+			}
+			res := LookupEnvOrInt(envName, tt.defaultValue)
+			assert.Equal(t, tt.expected, res)
+		})
+	}
+}
+
 func TestLookupEnvOrDuration(t *testing.T) {
 	t.Parallel()
 	tests := []struct {
@@ -0,0 +1,155 @@
+package retry
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DefaultDelay is the time waited between two upstream attempts
+const DefaultDelay = 500 * time.Millisecond
+
+type transport struct {
+	base       http.RoundTripper
+	statuses   []int
+	maxRetries int
+	delay      time.Duration
+}
+
+// NewTransport wraps the RoundTripper and retries idempotent requests up to
+// maxRetries times if the upstream server responds with one of the statuses.
+// Retries stop as soon as the request context is done. If no statuses are
+// given the base RoundTripper is returned.
+func NewTransport(base http.RoundTripper, statuses []int, maxRetries int) http.RoundTripper {
+	if len(statuses) == 0 || maxRetries <= 0 {
+		return base
+	}
+	return &transport{
+		base:       base,
+		statuses:   statuses,
+		maxRetries: maxRetries,
+		delay:      DefaultDelay,
+	}
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	for attempt := 0; attempt < t.maxRetries; attempt++ {
+		if err != nil || !slices.Contains(t.statuses, resp.StatusCode) || !canRetry(req) {
+			return resp, err
+		}
+
+		timer := time.NewTimer(t.delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			// return the last response as we are not able to do better
+			return resp, nil
+		case <-timer.C:
+		}
+
+		// discard the old response so the connection can be reused
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+
+		if req.Body != nil && req.Body != http.NoBody {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+		resp, err = t.base.RoundTrip(req)
+	}
+	return resp, err
+}
+
+// canRetry reports whether the request can safely be sent again
+func canRetry(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	// the body is consumed by the first attempt so we need a way to recreate it
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+type errorTransport struct {
+	base       http.RoundTripper
+	maxRetries int
+	delay      time.Duration
+}
+
+// NewErrorTransport wraps the RoundTripper and retries GET and HEAD requests
+// up to maxRetries times if connecting to the upstream server failed or timed
+// out. The delay between the attempts doubles after every retry and retries
+// stop if the request context would be done before the next attempt. If
+// maxRetries is not positive the base RoundTripper is returned.
+func NewErrorTransport(base http.RoundTripper, maxRetries int) http.RoundTripper {
+	if maxRetries <= 0 {
+		return base
+	}
+	return &errorTransport{
+		base:       base,
+		maxRetries: maxRetries,
+		delay:      DefaultDelay,
+	}
+}
+
+func (t *errorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	delay := t.delay
+	for attempt := 0; attempt < t.maxRetries; attempt++ {
+		if err == nil || !isTransient(err) || !canRetryError(req) {
+			return resp, err
+		}
+
+		// do not wait if the deadline would be exceeded anyway
+		if deadline, ok := req.Context().Deadline(); ok && time.Until(deadline) < delay {
+			return resp, err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return resp, err
+		case <-timer.C:
+		}
+		delay *= 2
+
+		resp, err = t.base.RoundTrip(req)
+	}
+	return resp, err
+}
+
+// canRetryError reports whether the request can be sent again after an error.
+// Only requests without a body are retried as the body might have been sent
+// partially before the error occurred.
+func canRetryError(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody
+}
+
+// isTransient reports whether err is a connection error that might not
+// happen again on the next attempt, like a failed circuit. A done request
+// context is handled by the caller.
+func isTransient(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && (opErr.Op == "dial" || strings.HasPrefix(opErr.Op, "socks")) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET)
+}
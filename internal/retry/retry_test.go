@@ -0,0 +1,249 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer(t *testing.T, failures int32, status int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= failures {
+			w.WriteHeader(status)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok" + string(body)))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func newTestTransport(statuses []int, maxRetries int) http.RoundTripper {
+	tr := NewTransport(http.DefaultTransport, statuses, maxRetries).(*transport)
+	tr.delay = time.Millisecond
+	return tr
+}
+
+func TestRetry(t *testing.T) {
+	t.Parallel()
+
+	srv, calls := newTestServer(t, 1, http.StatusServiceUnavailable)
+	client := http.Client{Transport: newTestTransport([]int{http.StatusBadGateway, http.StatusServiceUnavailable}, 2)}
+
+	resp, err := client.Get(srv.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, int32(2), calls.Load())
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "ok", string(body))
+}
+
+func TestRetryWithBody(t *testing.T) {
+	t.Parallel()
+
+	srv, calls := newTestServer(t, 1, http.StatusServiceUnavailable)
+	client := http.Client{Transport: newTestTransport([]int{http.StatusServiceUnavailable}, 2)}
+
+	req, err := http.NewRequest(http.MethodPut, srv.URL, strings.NewReader("body"))
+	require.NoError(t, err)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, int32(2), calls.Load())
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "okbody", string(body))
+}
+
+func TestRetryExhausted(t *testing.T) {
+	t.Parallel()
+
+	srv, calls := newTestServer(t, 10, http.StatusServiceUnavailable)
+	client := http.Client{Transport: newTestTransport([]int{http.StatusServiceUnavailable}, 2)}
+
+	resp, err := client.Get(srv.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Equal(t, int32(3), calls.Load())
+}
+
+func TestNoRetry(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		method string
+		status int
+	}{
+		{"status not configured", http.MethodGet, http.StatusInternalServerError},
+		{"not idempotent", http.MethodPost, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			srv, calls := newTestServer(t, 1, tt.status)
+			client := http.Client{Transport: newTestTransport([]int{http.StatusServiceUnavailable}, 2)}
+
+			req, err := http.NewRequest(tt.method, srv.URL, nil)
+			require.NoError(t, err)
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, tt.status, resp.StatusCode)
+			require.Equal(t, int32(1), calls.Load())
+		})
+	}
+}
+
+func TestRetryContextDone(t *testing.T) {
+	t.Parallel()
+
+	srv, calls := newTestServer(t, 1, http.StatusServiceUnavailable)
+	tr := NewTransport(http.DefaultTransport, []int{http.StatusServiceUnavailable}, 2).(*transport)
+	tr.delay = time.Hour
+	client := http.Client{Transport: tr}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	require.NoError(t, err)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Equal(t, int32(1), calls.Load())
+}
+
+func TestNewTransportWithoutStatuses(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, http.DefaultTransport, NewTransport(http.DefaultTransport, nil, 2))
+}
+
+// flakyTransport fails the first requests with err
+type flakyTransport struct {
+	failures int32
+	err      error
+	calls    atomic.Int32
+}
+
+func (f *flakyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if f.calls.Add(1) <= f.failures {
+		return nil, f.err
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+}
+
+func newTestErrorTransport(base http.RoundTripper, maxRetries int) *errorTransport {
+	tr := NewErrorTransport(base, maxRetries).(*errorTransport)
+	tr.delay = time.Millisecond
+	return tr
+}
+
+func TestErrorRetry(t *testing.T) {
+	t.Parallel()
+
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	socksErr := &net.OpError{Op: "socks connect", Net: "tcp", Err: errors.New("host unreachable")}
+	tests := []struct {
+		name     string
+		method   string
+		body     io.Reader
+		failures int32
+		err      error
+		success  bool
+		calls    int32
+	}{
+		{"dial error", http.MethodGet, nil, 2, dialErr, true, 3},
+		{"socks error", http.MethodHead, nil, 1, socksErr, true, 2},
+		{"timeout", http.MethodGet, nil, 1, context.DeadlineExceeded, true, 2},
+		{"connection reset", http.MethodGet, nil, 1, syscall.ECONNRESET, true, 2},
+		{"too many failures", http.MethodGet, nil, 5, dialErr, false, 4},
+		{"not transient", http.MethodGet, nil, 1, errors.New("invalid response"), false, 1},
+		{"canceled", http.MethodGet, nil, 1, context.Canceled, false, 1},
+		{"not idempotent", http.MethodPost, nil, 1, dialErr, false, 1},
+		{"with body", http.MethodGet, strings.NewReader("body"), 1, dialErr, false, 1},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			base := &flakyTransport{failures: tt.failures, err: tt.err}
+			tr := newTestErrorTransport(base, 3)
+
+			req, err := http.NewRequest(tt.method, "http://example.onion/", tt.body)
+			require.NoError(t, err)
+			resp, err := tr.RoundTrip(req)
+			if tt.success {
+				require.NoError(t, err)
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+			} else {
+				require.ErrorIs(t, err, tt.err)
+			}
+			require.Equal(t, tt.calls, base.calls.Load())
+		})
+	}
+}
+
+func TestErrorRetryBackoff(t *testing.T) {
+	t.Parallel()
+
+	base := &flakyTransport{failures: 3, err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}}
+	tr := newTestErrorTransport(base, 3)
+	tr.delay = 10 * time.Millisecond
+
+	req, err := http.NewRequest(http.MethodGet, "http://example.onion/", nil)
+	require.NoError(t, err)
+	start := time.Now()
+	resp, err := tr.RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	// 10ms + 20ms + 40ms
+	require.GreaterOrEqual(t, time.Since(start), 70*time.Millisecond)
+}
+
+func TestErrorRetryDeadline(t *testing.T) {
+	t.Parallel()
+
+	base := &flakyTransport{failures: 1, err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}}
+	tr := newTestErrorTransport(base, 3)
+	tr.delay = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.onion/", nil)
+	require.NoError(t, err)
+	start := time.Now()
+	_, err = tr.RoundTrip(req)
+	require.Error(t, err)
+	require.Equal(t, int32(1), base.calls.Load())
+	require.Less(t, time.Since(start), time.Second)
+}
+
+func TestNewErrorTransportDisabled(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, http.DefaultTransport, NewErrorTransport(http.DefaultTransport, 0))
+}
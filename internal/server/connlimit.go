@@ -0,0 +1,39 @@
+package server
+
+import "sync"
+
+// connLimiter tracks the number of active requests per client ip
+type connLimiter struct {
+	max   int
+	mu    sync.Mutex
+	conns map[string]int
+}
+
+func newConnLimiter(max int) *connLimiter {
+	return &connLimiter{
+		max:   max,
+		conns: make(map[string]int),
+	}
+}
+
+// acquire returns false if the ip already has the maximum number of
+// active requests. Otherwise the request is counted until release is called.
+func (l *connLimiter) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip] >= l.max {
+		return false
+	}
+	l.conns[ip]++
+	return true
+}
+
+func (l *connLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.conns[ip]--
+	// do not keep entries of inactive clients around
+	if l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+}
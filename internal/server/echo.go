@@ -3,14 +3,18 @@ package server
 import (
 	"errors"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
 
 	"github.com/firefart/zwiebelproxy/internal/server/handlers"
-	"github.com/firefart/zwiebelproxy/internal/server/templates"
 	"github.com/labstack/echo/v4"
 )
 
 var cloudflareIPHeaderName = http.CanonicalHeaderKey("CF-Connecting-IP")
+var forwardedHeaderName = http.CanonicalHeaderKey("Forwarded")
 
 func (s *server) customHTTPErrorHandler(err error, c echo.Context) {
 	if c.Response().Committed {
@@ -25,12 +29,23 @@ func (s *server) customHTTPErrorHandler(err error, c echo.Context) {
 		message = echoError.Message.(string)
 	}
 
+	// denied requests are written to the audit log
+	switch statusCode {
+	case http.StatusForbidden, http.StatusMethodNotAllowed, http.StatusTooManyRequests:
+		handlers.Audit(s.auditLogger, c.RealIP(), message, c.Request())
+	}
+
 	// ignore 404 and stuff
 	if err != nil && statusCode > 499 {
+		s.stats.IncError()
 		s.logger.Error("error on request", slog.String("err", err.Error()))
 	}
 
-	if err2 := handlers.Render(c, statusCode, templates.Index(message)); err2 != nil {
+	c.Response().Header().Set(handlers.ErrorCodeHeader, handlers.ErrorCode(err, statusCode))
+	if !s.allowFraming {
+		handlers.DenyFraming(c.Response().Header())
+	}
+	if err2 := handlers.Render(c, statusCode, s.errorTemplate(message)); err2 != nil {
 		s.logger.Error(err2.Error())
 	}
 }
@@ -44,3 +59,79 @@ func extractIPFromCloudflareHeader() echo.IPExtractor {
 		return echo.ExtractIPDirect()(req)
 	}
 }
+
+func extractIPFromForwardedHeader(trusted []netip.Prefix) echo.IPExtractor {
+	return func(req *http.Request) string {
+		if ip, ok := forwardedIP(forwardedElement(req, trusted)["for"]); ok {
+			return ip.String()
+		}
+		// fall back to normal ip extraction
+		return echo.ExtractIPDirect()(req)
+	}
+}
+
+// forwardedElement returns the parameters of the element of the RFC 7239
+// Forwarded headers added by the trusted proxy closest to the client. Proxies
+// append their element so the elements are walked from the right and the first
+// one not coming from a trusted proxy is returned. The elements on the left
+// are sent by the client and can not be trusted. Nil is returned if the request
+// was not sent by a trusted proxy or does not contain a Forwarded header.
+func forwardedElement(req *http.Request, trusted []netip.Prefix) map[string]string {
+	if ip, ok := forwardedIP(echo.ExtractIPDirect()(req)); !ok || !containsIP(trusted, ip) {
+		return nil
+	}
+	var elements []string
+	for _, header := range req.Header.Values(forwardedHeaderName) {
+		elements = append(elements, strings.Split(header, ",")...)
+	}
+	if len(elements) == 0 {
+		return nil
+	}
+	for i := len(elements) - 1; i > 0; i-- {
+		params := parseForwarded(elements[i])
+		if ip, ok := forwardedIP(params["for"]); !ok || !containsIP(trusted, ip) {
+			return params
+		}
+	}
+	return parseForwarded(elements[0])
+}
+
+// forwardedIP parses the ip of a for parameter. IPv6 addresses are enclosed
+// in brackets and might contain a port.
+func forwardedIP(value string) (netip.Addr, bool) {
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+	ip, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(value, "["), "]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ip.Unmap(), true
+}
+
+func containsIP(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseForwarded returns the parameters of a single element of a RFC 7239
+// Forwarded header
+func parseForwarded(element string) map[string]string {
+	params := make(map[string]string)
+	for _, pair := range strings.Split(element, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		params[strings.ToLower(strings.TrimSpace(key))] = value
+	}
+	return params
+}
@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/firefart/zwiebelproxy/internal/helper"
+)
+
+type clientIPKey struct{}
+
+// Audit logs a denied request to the audit log. Nothing is logged if logger is nil.
+func Audit(logger *slog.Logger, ip, reason string, r *http.Request) {
+	if logger == nil {
+		return
+	}
+	logger.Warn("request denied",
+		slog.String("ip", ip),
+		slog.String("reason", reason),
+		slog.String("method", r.Method),
+		slog.String("target", helper.SanitizeString(r.Host+r.RequestURI)),
+	)
+}
+
+// clientIP returns the ip of the client stored in the request context
+func clientIP(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey{}).(string)
+	return ip
+}
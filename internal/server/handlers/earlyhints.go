@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"maps"
+	"net/http"
+)
+
+// earlyHintsWriter handles 103 Early Hints responses. The reverse proxy
+// writes them directly to the client without calling ModifyResponse so the
+// onion addresses in the preload links need to be rewritten here.
+type earlyHintsWriter struct {
+	http.ResponseWriter
+	// informational receives the 1xx responses. Wrappers like echo.Response
+	// treat every status as final and would drop the real status afterwards.
+	informational http.ResponseWriter
+	rewrite       func(http.Header) http.Header
+	drop          bool
+}
+
+func newEarlyHintsWriter(w, informational http.ResponseWriter, rewrite func(http.Header) http.Header, drop bool) *earlyHintsWriter {
+	return &earlyHintsWriter{
+		ResponseWriter: w,
+		informational:  informational,
+		rewrite:        rewrite,
+		drop:           drop,
+	}
+}
+
+func (w *earlyHintsWriter) WriteHeader(statusCode int) {
+	if statusCode == http.StatusEarlyHints {
+		// the reverse proxy clears the headers after writing informational responses
+		if w.drop {
+			return
+		}
+		header := w.Header()
+		rewritten := w.rewrite(header)
+		clear(header)
+		maps.Copy(header, rewritten)
+	}
+	// 101 Switching Protocols is the final response of an upgrade
+	if statusCode >= 100 && statusCode < 200 && statusCode != http.StatusSwitchingProtocols {
+		w.informational.WriteHeader(statusCode)
+		return
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Unwrap is used by http.ResponseController
+func (w *earlyHintsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/firefart/zwiebelproxy/internal/tor"
+)
+
+// ErrorCodeHeader is set on all errors generated by the proxy and contains
+// a stable error code so tools don't need to parse the html error page
+const ErrorCodeHeader = "X-Zwiebel-Error"
+
+const (
+	ErrorCodeBlacklisted      = "blacklisted"
+	ErrorCodeOnionOffline     = "onion_offline"
+	ErrorCodeProxyErrorPage   = "proxy_error_page"
+	ErrorCodeTimeout          = "timeout"
+	ErrorCodeBadRequest       = "bad_request"
+	ErrorCodeForbidden        = "forbidden"
+	ErrorCodeNotFound         = "not_found"
+	ErrorCodeMethodNotAllowed = "method_not_allowed"
+	ErrorCodeRequestTooLarge  = "request_too_large"
+	ErrorCodeTooManyRequests  = "too_many_requests"
+	ErrorCodeUpstream         = "upstream_error"
+	ErrorCodeInternal         = "internal_error"
+)
+
+var statusErrorCodes = map[int]string{
+	http.StatusBadRequest:            ErrorCodeBadRequest,
+	http.StatusForbidden:             ErrorCodeForbidden,
+	http.StatusNotFound:              ErrorCodeNotFound,
+	http.StatusMethodNotAllowed:      ErrorCodeMethodNotAllowed,
+	http.StatusRequestEntityTooLarge: ErrorCodeRequestTooLarge,
+	http.StatusTooManyRequests:       ErrorCodeTooManyRequests,
+	http.StatusBadGateway:            ErrorCodeUpstream,
+	http.StatusGatewayTimeout:        ErrorCodeTimeout,
+}
+
+// ErrorCode returns the error code for err. If the error itself has no
+// specific code the code is derived from the status code of the response.
+func ErrorCode(err error, statusCode int) string {
+	var blacklistedError *tor.BlacklistedError
+	if errors.As(err, &blacklistedError) {
+		return ErrorCodeBlacklisted
+	}
+	var proxyErrorPageError *tor.ProxyErrorPageError
+	if errors.As(err, &proxyErrorPageError) {
+		return ErrorCodeProxyErrorPage
+	}
+	if tor.SOCKSErrorMessage(err) != "" {
+		return ErrorCodeOnionOffline
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return ErrorCodeTimeout
+	}
+	if code, ok := statusErrorCodes[statusCode]; ok {
+		return code
+	}
+	return ErrorCodeInternal
+}
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// flushWriter wraps the response writer handed to the reverse proxy.
+// The proxy is configured to flush after every write which is what we want for
+// streaming responses (SSE, pages without a content length) but adds a lot of
+// syscalls on large file downloads. flushWriter decides per response on
+// WriteHeader if the flushes should be passed through or if the default
+// buffering of the http server should be used.
+type flushWriter struct {
+	http.ResponseWriter
+	buffered bool
+}
+
+func newFlushWriter(w http.ResponseWriter) *flushWriter {
+	return &flushWriter{
+		ResponseWriter: w,
+	}
+}
+
+func (w *flushWriter) WriteHeader(statusCode int) {
+	w.buffered = !isStreamingResponse(w.Header())
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *flushWriter) Flush() {
+	if w.buffered {
+		return
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap is used by http.ResponseController
+func (w *flushWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// isStreamingResponse returns true if the response needs to be flushed immediately
+func isStreamingResponse(header http.Header) bool {
+	// file downloads are never streamed
+	// https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Content-Disposition
+	if strings.HasPrefix(header.Get("Content-Disposition"), "attachment") {
+		return false
+	}
+
+	// Server-Sent Events
+	if baseCT, _, _ := mime.ParseMediaType(header.Get("Content-Type")); baseCT == "text/event-stream" {
+		return true
+	}
+
+	// no content length means we might have a streaming response
+	return header.Get("Content-Length") == ""
+}
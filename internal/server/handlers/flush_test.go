@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlushWriter(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name            string
+		header          map[string]string
+		expectedFlushed bool
+	}{
+		{"download", map[string]string{"Content-Disposition": `attachment; filename="file.zip"`, "Content-Length": "1000"}, false},
+		{"download without length", map[string]string{"Content-Disposition": `attachment; filename="file.zip"`}, false},
+		{"known length", map[string]string{"Content-Type": "image/png", "Content-Length": "1000"}, false},
+		{"sse", map[string]string{"Content-Type": "text/event-stream", "Content-Length": "1000"}, true},
+		{"unknown length", map[string]string{"Content-Type": "text/html"}, true},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			rec := httptest.NewRecorder()
+			w := newFlushWriter(rec)
+			for k, v := range tt.header {
+				w.Header().Set(k, v)
+			}
+			w.WriteHeader(http.StatusOK)
+			_, err := w.Write([]byte("test"))
+			require.NoError(t, err)
+			require.NoError(t, http.NewResponseController(w).Flush())
+			assert.Equal(t, tt.expectedFlushed, rec.Flushed)
+		})
+	}
+}
+
+type discardFlusher struct {
+	header  http.Header
+	flushes int
+}
+
+func (d *discardFlusher) Header() http.Header         { return d.header }
+func (d *discardFlusher) Write(b []byte) (int, error) { return len(b), nil }
+func (d *discardFlusher) WriteHeader(int)             {}
+func (d *discardFlusher) Flush()                      { d.flushes++ }
+
+func BenchmarkFlushWriterLargeDownload(b *testing.B) {
+	data := bytes.Repeat([]byte("A"), 64*1024*1024)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d := &discardFlusher{header: make(http.Header)}
+		w := newFlushWriter(d)
+		w.Header().Set("Content-Disposition", `attachment; filename="file.zip"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(http.StatusOK)
+		buf := make([]byte, 32*1024)
+		if _, err := io.CopyBuffer(flushingWriter{w}, bytes.NewReader(data), buf); err != nil {
+			b.Fatal(err)
+		}
+		if d.flushes != 0 {
+			b.Fatalf("expected no flushes, got %d", d.flushes)
+		}
+	}
+}
+
+// flushingWriter mimics the reverse proxy with a FlushInterval of -1
+type flushingWriter struct {
+	w *flushWriter
+}
+
+func (f flushingWriter) Write(b []byte) (int, error) {
+	n, err := f.w.Write(b)
+	f.w.Flush()
+	return n, err
+}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/firefart/zwiebelproxy/internal/tor"
+	"github.com/labstack/echo/v4"
+)
+
+// readyTimeout limits the tor proxy check of the readiness handler so load
+// balancers get an answer before their own health check times out
+const readyTimeout = 3 * time.Second
+
+type HealthHandler struct {
+	logger    *slog.Logger
+	grace     time.Duration
+	onDrained func()
+	draining  atomic.Bool
+	torProxy  string
+	timeout   time.Duration
+}
+
+type Readiness struct {
+	Ready  bool   `json:"ready"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// NewHealthHandler creates the health check handler. After draining was
+// started onDrained is called once the grace period is over. torProxy is the
+// host:port of the tor socks proxy checked by the readiness handler.
+func NewHealthHandler(logger *slog.Logger, grace time.Duration, onDrained func(), torProxy string, timeout time.Duration) *HealthHandler {
+	return &HealthHandler{
+		logger:    logger,
+		grace:     grace,
+		onDrained: onDrained,
+		torProxy:  torProxy,
+		timeout:   timeout,
+	}
+}
+
+// Handler returns 503 while draining so load balancers stop sending new traffic
+func (h *HealthHandler) Handler(c echo.Context) error {
+	if h.draining.Load() {
+		return c.String(http.StatusServiceUnavailable, "draining")
+	}
+	return c.String(http.StatusOK, "ok")
+}
+
+// ReadyHandler returns 503 while draining or if the tor proxy does not answer
+// a SOCKS5 handshake so load balancers only send traffic if tor is usable
+func (h *HealthHandler) ReadyHandler(c echo.Context) error {
+	if h.draining.Load() {
+		return c.JSON(http.StatusServiceUnavailable, Readiness{Reason: "draining"})
+	}
+
+	timeout := min(h.timeout, readyTimeout)
+	ctx, cancel := context.WithTimeout(c.Request().Context(), timeout)
+	defer cancel()
+	if err := tor.CheckProxy(ctx, tor.NewDialer(timeout, -1), h.torProxy); err != nil {
+		h.logger.Warn("tor proxy not ready", slog.String("tor", h.torProxy), slog.String("err", err.Error()))
+		return c.JSON(http.StatusServiceUnavailable, Readiness{Reason: fmt.Sprintf("tor proxy not reachable: %v", err)})
+	}
+	return c.JSON(http.StatusOK, Readiness{Ready: true})
+}
+
+// DrainHandler starts draining. Requests are still served during the
+// grace period, afterwards onDrained is called to shut down the server.
+func (h *HealthHandler) DrainHandler(c echo.Context) error {
+	if c.Request().Method != http.MethodPost {
+		c.Response().Header().Set(echo.HeaderAllow, http.MethodPost)
+		return echo.NewHTTPError(http.StatusMethodNotAllowed, "method not allowed")
+	}
+
+	if h.draining.Swap(true) {
+		return c.String(http.StatusAccepted, "already draining")
+	}
+
+	h.logger.Info("draining server", slog.Duration("grace", h.grace))
+	time.AfterFunc(h.grace, func() {
+		h.logger.Info("drain grace period is over")
+		if h.onDrained != nil {
+			h.onDrained()
+		}
+	})
+	return c.String(http.StatusAccepted, "draining")
+}
@@ -2,37 +2,103 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"math/rand/v2"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"strings"
 	"time"
 
+	"github.com/a-h/templ"
+	"github.com/firefart/zwiebelproxy/internal/config"
+	"github.com/firefart/zwiebelproxy/internal/retry"
 	"github.com/firefart/zwiebelproxy/internal/server/templates"
+	"github.com/firefart/zwiebelproxy/internal/stats"
 	"github.com/firefart/zwiebelproxy/internal/tor"
+	"github.com/firefart/zwiebelproxy/internal/tracing"
 	"github.com/labstack/echo/v4"
 )
 
 type IndexHandler struct {
-	domain           string
-	debug            bool
-	blacklistedWords string
-	logger           *slog.Logger
-	transport        *http.Transport
-	timeout          time.Duration
+	domain          string
+	debug           bool
+	logger          *slog.Logger
+	transport       *http.Transport
+	timeout         time.Duration
+	requestDeadline time.Duration
+	responseJitter  time.Duration
+	config          config.Config
+	stats           stats.Stats
+	landingTemplate templates.Template
+	errorTemplate   templates.Template
+	blockedTemplate templates.Template
+	tor             *tor.Tor
+	// blockedOnions contains the normalized onion addresses that are never proxied
+	blockedOnions map[string]struct{}
+	// proxy is shared by all requests, the onion is taken from the request host
+	proxy    *httputil.ReverseProxy
+	proxyErr error
 }
 
-func NewIndexHandler(logger *slog.Logger, debug bool, domain string, blacklistedWords string, transport *http.Transport, timeout time.Duration) *IndexHandler {
-	return &IndexHandler{
-		logger:           logger,
-		debug:            debug,
-		domain:           domain,
-		blacklistedWords: blacklistedWords,
-		transport:        transport,
-		timeout:          timeout,
+func NewIndexHandler(logger *slog.Logger, cfg config.Config, transport *http.Transport, st stats.Stats) *IndexHandler {
+	// the names are validated on startup so fall back to the default on errors
+	landingTemplate, err := templates.Get(cfg.LandingTemplate)
+	if err != nil {
+		landingTemplate = templates.Index
+	}
+	errorTemplate, err := templates.Get(cfg.ErrorTemplate)
+	if err != nil {
+		errorTemplate = templates.Index
+	}
+
+	h := &IndexHandler{
+		logger:          logger,
+		stats:           st,
+		debug:           cfg.Debug,
+		domain:          strings.ToLower(cfg.Domain),
+		transport:       transport,
+		timeout:         cfg.Timeout,
+		requestDeadline: cfg.RequestDeadline,
+		responseJitter:  cfg.ResponseJitter,
+		config:          cfg,
+		landingTemplate: templates.WithCSS(landingTemplate, cfg.PageCSS),
+		errorTemplate:   templates.WithCSS(errorTemplate, cfg.PageCSS),
+		// the blocked page does not show the error message
+		blockedTemplate: templates.WithCSS(func(string) templ.Component { return templates.Blocked() }, cfg.PageCSS),
+	}
+
+	h.blockedOnions = make(map[string]struct{}, len(cfg.BlockedOnions))
+	for _, onion := range cfg.BlockedOnions {
+		h.blockedOnions[tor.NormalizeOnion(onion)] = struct{}{}
+	}
+
+	h.tor, h.proxyErr = tor.New(logger, cfg)
+	if h.proxyErr != nil {
+		h.proxyErr = fmt.Errorf("could not create tor object: %w", h.proxyErr)
+		return h
+	}
+
+	h.proxy = &httputil.ReverseProxy{
+		Rewrite:        h.tor.Rewrite,
+		FlushInterval:  -1,
+		ModifyResponse: h.modifyResponse,
+		Transport:      tracing.NewTransport(retry.NewTransport(retry.NewErrorTransport(transport, cfg.UpstreamRetries), cfg.RetryStatuses, cfg.RetryMax)),
+		ErrorHandler:   h.errorHandler,
+	}
+	return h
+}
+
+// WatchBlacklist keeps the blacklist in sync with the configured
+// blacklist url until ctx is canceled
+func (h *IndexHandler) WatchBlacklist(ctx context.Context) {
+	if h.tor == nil || h.config.BlacklistURL == "" {
+		return
 	}
+	f := tor.NewBlacklistFetcher(h.config.BlacklistURL, &http.Client{Timeout: h.timeout})
+	go h.tor.WatchBlacklist(ctx, f, h.config.BlacklistRefresh)
 }
 
 func (h *IndexHandler) Handler(c echo.Context) error {
@@ -42,35 +108,58 @@ func (h *IndexHandler) Handler(c echo.Context) error {
 		// no port present
 		host = r.Host
 	}
+	// strip the trailing dot of fully qualified host names
+	host = strings.TrimSuffix(host, ".")
+	// host names are case insensitive
+	host = strings.ToLower(host)
+
+	if host == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "missing host header")
+	}
 
 	// show info page when top domain is called
 	if host == strings.TrimLeft(h.domain, ".") {
-		return Render(c, http.StatusOK, templates.Index(""))
+		// the info page is static so only allow GET and HEAD without a body
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			c.Response().Header().Set(echo.HeaderAllow, fmt.Sprintf("%s, %s", http.MethodGet, http.MethodHead))
+			return echo.NewHTTPError(http.StatusMethodNotAllowed, "method not allowed")
+		}
+		if r.ContentLength != 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "request body not allowed")
+		}
+		if !h.config.AllowFraming {
+			DenyFraming(c.Response().Header())
+		}
+		return Render(c, http.StatusOK, h.landingTemplate(""))
 	}
 
 	if !strings.HasSuffix(host, h.domain) {
 		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid domain %s called. The domain needs to end in %s", host, h.domain))
 	}
 
-	tor, err := tor.New(h.logger, h.domain, h.blacklistedWords)
-	if err != nil {
-		return fmt.Errorf("could not create tor object: %w", err)
+	if strings.TrimSuffix(host, h.domain) == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid domain %s called. Please provide an onion address", host))
 	}
 
-	proxy := httputil.ReverseProxy{
-		Rewrite:        tor.Rewrite,
-		FlushInterval:  -1,
-		ModifyResponse: tor.ModifyResponse,
-		Transport:      h.transport,
-		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
-			h.logger.Error("error on reverse proxy", slog.String("url", r.RequestURI), slog.String("err", err.Error()))
-			w.WriteHeader(http.StatusBadGateway)
-			w.Header().Set("Content-Type", "text/html")
-			w.Header().Set("Connection", "close")
-			if err := templates.Index(err.Error()).Render(r.Context(), w); err != nil {
-				panic(err.Error())
-			}
-		},
+	name := tor.NormalizeOnion(strings.TrimSuffix(host, h.domain))
+	// fail fast instead of letting tor try to connect to an invalid onion
+	if h.config.ValidateOnions && !tor.ValidOnionAddress(name) {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid onion address %s.onion called. Only v3 onion addresses are supported", name))
+	}
+
+	// blocked onions are not contacted at all
+	if _, ok := h.blockedOnions[name]; ok {
+		h.logger.Warn("blocked request to a blocked onion", slog.String("onion", name))
+		h.stats.IncBlock()
+		Audit(h.config.AuditLogger, c.RealIP(), "blocked onion", r)
+		if !h.config.AllowFraming {
+			DenyFraming(c.Response().Header())
+		}
+		return Render(c, http.StatusForbidden, h.blockedTemplate(""))
+	}
+
+	if h.proxyErr != nil {
+		return h.proxyErr
 	}
 
 	h.logger.Debug("original request", slog.String("request", fmt.Sprintf("%+v", r)))
@@ -78,7 +167,91 @@ func (h *IndexHandler) Handler(c echo.Context) error {
 	// set a custom timeout
 	ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
 	defer cancel()
+	// the request deadline bounds the whole request including all upstream attempts
+	if h.requestDeadline > 0 {
+		var cancelDeadline context.CancelFunc
+		ctx, cancelDeadline = context.WithTimeout(ctx, h.requestDeadline)
+		defer cancelDeadline()
+	}
+	// the client ip is needed to audit blocked responses in the error handler
+	ctx = context.WithValue(ctx, clientIPKey{}, c.RealIP())
 	r = r.WithContext(ctx)
-	proxy.ServeHTTP(c.Response().Writer, r)
+	w := newEarlyHintsWriter(newFlushWriter(c.Response()), c.Response().Writer, h.tor.RewriteHeader, h.config.DropEarlyHints)
+	start := time.Now()
+	h.proxy.ServeHTTP(w, r)
+	h.stats.ObserveUpstreamLatency(time.Since(start))
 	return nil
 }
+
+// delay waits a random duration up to the response jitter to make timing
+// correlation of responses harder
+func (h *IndexHandler) delay(ctx context.Context) error {
+	if h.responseJitter <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(time.Duration(rand.Int64N(int64(h.responseJitter))))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("request aborted: %w", ctx.Err())
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (h *IndexHandler) modifyResponse(resp *http.Response) error {
+	if resp.StatusCode >= http.StatusInternalServerError {
+		h.stats.IncUpstreamError()
+	}
+	if err := h.tor.ModifyResponse(resp); err != nil {
+		return err
+	}
+	return h.delay(resp.Request.Context())
+}
+
+func (h *IndexHandler) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	// failed and blocked responses are delayed like successful ones so the
+	// timing does not reveal the outcome. An aborted request is not delayed.
+	_ = h.delay(r.Context())
+	statusCode := http.StatusBadGateway
+	page := h.errorTemplate
+	var blacklistedError *tor.BlacklistedError
+	if errors.As(err, &blacklistedError) {
+		// the matched word is only logged and not shown to the user
+		h.logger.Warn("blocked response containing a blacklisted word", slog.String("url", r.RequestURI), slog.String("word", blacklistedError.Word))
+		h.stats.IncBlock()
+		Audit(h.config.AuditLogger, clientIP(r.Context()), err.Error(), r)
+		statusCode = http.StatusForbidden
+		page = h.blockedTemplate
+	} else {
+		h.logger.Error("error on reverse proxy", slog.String("url", r.RequestURI), slog.String("err", err.Error()))
+		h.stats.IncError()
+		// errors caused by the client like a too big body or a closed connection
+		// do not say anything about the onion
+		var clientErr *echo.HTTPError
+		if !errors.As(err, &clientErr) && !errors.Is(err, context.Canceled) {
+			h.stats.IncUpstreamError()
+		}
+	}
+	// errors returned from middlewares wrapping the request body like the body limit
+	var echoError *echo.HTTPError
+	if errors.As(err, &echoError) {
+		statusCode = echoError.Code
+	}
+	message := err.Error()
+	// show a readable message if tor could not reach the onion
+	if m := tor.SOCKSErrorMessage(err); m != "" {
+		message = m
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Connection", "close")
+	w.Header().Set(ErrorCodeHeader, ErrorCode(err, statusCode))
+	if !h.config.AllowFraming {
+		DenyFraming(w.Header())
+	}
+	w.WriteHeader(statusCode)
+	// the request context might already be canceled because of a timeout
+	if err := page(message).Render(context.WithoutCancel(r.Context()), w); err != nil {
+		panic(err.Error())
+	}
+}
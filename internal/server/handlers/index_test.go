@@ -2,17 +2,30 @@ package handlers_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"net/url"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/firefart/zwiebelproxy/internal/config"
 	"github.com/firefart/zwiebelproxy/internal/server"
 	"github.com/firefart/zwiebelproxy/internal/server/handlers"
+	"github.com/firefart/zwiebelproxy/internal/stats"
+	"github.com/firefart/zwiebelproxy/internal/tor"
 	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -30,13 +43,893 @@ func TestIndex(t *testing.T) {
 	defer os.Remove(file.Name())
 
 	tr := http.DefaultTransport.(*http.Transport)
-	e := server.NewServer(ctx, logger, false, false, false, "localhost.onion", "", "TEST", "TEST", 1*time.Minute, 1*time.Minute, nil, nil, nil, tr)
+	cfg := config.Config{
+		Domain:               "localhost.onion",
+		SecretKeyHeaderName:  "TEST",
+		SecretKeyHeaderValue: "TEST",
+		Timeout:              1 * time.Minute,
+		DNSCacheTimeout:      1 * time.Minute,
+	}
+	e := server.NewServer(ctx, logger, cfg, tr, nil)
 	x, ok := e.(*echo.Echo)
 	require.True(t, ok)
 	req := httptest.NewRequest(http.MethodGet, "https://test.localhost.onion", nil)
 	rec := httptest.NewRecorder()
 	cont := x.NewContext(req, rec)
-	require.Nil(t, handlers.NewIndexHandler(logger, false, "localhost.onion", "", tr, 1*time.Minute).Handler(cont))
+	require.Nil(t, handlers.NewIndexHandler(logger, cfg, tr, stats.Noop{}).Handler(cont))
 	require.Equal(t, http.StatusOK, rec.Code) //
 	require.Greater(t, len(rec.Body.String()), 10)
 }
+
+func TestIndexInvalidHost(t *testing.T) {
+	t.Parallel()
+
+	const domain = ".onion.zwiebel"
+	tests := []struct {
+		name         string
+		host         string
+		expectedCode int
+	}{
+		{"empty host", "", http.StatusBadRequest},
+		{"only domain", domain, http.StatusBadRequest},
+		{"only domain with port", fmt.Sprintf("%s:8080", domain), http.StatusBadRequest},
+		{"other domain", "test.example.com", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			tr := http.DefaultTransport.(*http.Transport)
+			e := echo.New()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = tt.host
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			err := handlers.NewIndexHandler(logger, config.Config{Domain: domain, Timeout: 1 * time.Minute}, tr, stats.Noop{}).Handler(c)
+			var httpErr *echo.HTTPError
+			require.ErrorAs(t, err, &httpErr)
+			require.Equal(t, tt.expectedCode, httpErr.Code)
+		})
+	}
+}
+
+func TestIndexValidateOnions(t *testing.T) {
+	t.Parallel()
+
+	const onion = "duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczad"
+	tests := []struct {
+		name         string
+		validate     bool
+		host         string
+		expectedCode int
+	}{
+		{"valid", true, fmt.Sprintf("%s.onion.zwiebel", onion), http.StatusOK},
+		{"valid with subdomain", true, fmt.Sprintf("www.%s.onion.zwiebel", onion), http.StatusOK},
+		{"valid with port", true, fmt.Sprintf("%s.onion.zwiebel:8080", onion), http.StatusOK},
+		{"too short", true, "duckduckgogg42xjoc72x3sjasowoarfbgcm.onion.zwiebel", http.StatusBadRequest},
+		{"invalid charset", true, "duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzcza1.onion.zwiebel", http.StatusBadRequest},
+		{"disabled", false, "test.onion.zwiebel", http.StatusOK},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var calls atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				w.Header().Set("Content-Type", "text/plain")
+				_, _ = w.Write([]byte("ok"))
+			}))
+			defer srv.Close()
+
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			cfg := config.Config{
+				Domain:         ".onion.zwiebel",
+				ValidateOnions: tt.validate,
+				Timeout:        1 * time.Minute,
+			}
+			e := echo.New()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = tt.host
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			err := handlers.NewIndexHandler(logger, cfg, newTestTransport(srv), stats.Noop{}).Handler(c)
+			if tt.expectedCode != http.StatusOK {
+				var httpErr *echo.HTTPError
+				require.ErrorAs(t, err, &httpErr)
+				require.Equal(t, tt.expectedCode, httpErr.Code)
+				// the onion is not contacted at all
+				require.Equal(t, int32(0), calls.Load())
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, rec.Code)
+			require.Equal(t, int32(1), calls.Load())
+		})
+	}
+}
+
+func TestIndexBlockedOnions(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name         string
+		host         string
+		expectedCode int
+	}{
+		{"exact match", "blocked.onion.zwiebel", http.StatusForbidden},
+		{"with port", "blocked.onion.zwiebel:8080", http.StatusForbidden},
+		{"subdomain", "www.blocked.onion.zwiebel", http.StatusForbidden},
+		{"uppercase", "BLOCKED.onion.zwiebel", http.StatusForbidden},
+		{"blocked with port in list", "other.onion.zwiebel", http.StatusForbidden},
+		{"not blocked", "allowed.onion.zwiebel", http.StatusOK},
+		{"blocked as subdomain", "blocked.allowed.onion.zwiebel", http.StatusOK},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var calls atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				w.Header().Set("Content-Type", "text/plain")
+				_, _ = w.Write([]byte("ok"))
+			}))
+			defer srv.Close()
+
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			cfg := config.Config{
+				Domain:        ".onion.zwiebel",
+				BlockedOnions: []string{"Blocked.onion", "other.onion:8443"},
+				Timeout:       1 * time.Minute,
+			}
+			e := echo.New()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = tt.host
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			require.NoError(t, handlers.NewIndexHandler(logger, cfg, newTestTransport(srv), stats.Noop{}).Handler(c))
+			require.Equal(t, tt.expectedCode, rec.Code)
+			if tt.expectedCode == http.StatusForbidden {
+				// the onion is not contacted at all
+				require.Equal(t, int32(0), calls.Load())
+			} else {
+				require.Equal(t, int32(1), calls.Load())
+			}
+		})
+	}
+}
+
+func TestIndexTopDomain(t *testing.T) {
+	t.Parallel()
+
+	for _, host := range []string{"onion.zwiebel", "onion.zwiebel.", "onion.zwiebel.:8080"} {
+		host := host
+		t.Run(host, func(t *testing.T) {
+			t.Parallel()
+
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			tr := http.DefaultTransport.(*http.Transport)
+			e := echo.New()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = host
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			require.NoError(t, handlers.NewIndexHandler(logger, config.Config{Domain: ".onion.zwiebel", Timeout: 1 * time.Minute}, tr, stats.Noop{}).Handler(c))
+			require.Equal(t, http.StatusOK, rec.Code)
+			require.Contains(t, rec.Body.String(), "ZWIEBELPROXY")
+		})
+	}
+}
+
+func TestIndexPageCSS(t *testing.T) {
+	t.Parallel()
+
+	const css = "body { background-color: #123456; }"
+	for _, name := range []string{"default", "minimal"} {
+		name := name
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			tr := http.DefaultTransport.(*http.Transport)
+			cfg := config.Config{
+				Domain:          ".onion.zwiebel",
+				Timeout:         1 * time.Minute,
+				LandingTemplate: name,
+				PageCSS:         css,
+			}
+			e := echo.New()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = "onion.zwiebel"
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			require.NoError(t, handlers.NewIndexHandler(logger, cfg, tr, stats.Noop{}).Handler(c))
+			require.Equal(t, http.StatusOK, rec.Code)
+			require.Contains(t, rec.Body.String(), fmt.Sprintf("<style>%s</style>", css))
+		})
+	}
+}
+
+func TestIndexDenyFraming(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name         string
+		host         string
+		allowFraming bool
+		deny         bool
+	}{
+		{"landing page", "onion.zwiebel", false, true},
+		{"landing page allowed", "onion.zwiebel", true, false},
+		{"onion", "test.onion.zwiebel", false, false},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				_, _ = w.Write([]byte("<html>onion</html>"))
+			}))
+			defer srv.Close()
+
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			cfg := config.Config{
+				Domain:       ".onion.zwiebel",
+				Timeout:      1 * time.Minute,
+				AllowFraming: tt.allowFraming,
+			}
+			e := echo.New()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = tt.host
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			require.NoError(t, handlers.NewIndexHandler(logger, cfg, newTestTransport(srv), stats.Noop{}).Handler(c))
+			require.Equal(t, http.StatusOK, rec.Code)
+			if tt.deny {
+				require.Equal(t, "frame-ancestors 'none'", rec.Header().Get("Content-Security-Policy"))
+				require.Equal(t, "DENY", rec.Header().Get("X-Frame-Options"))
+			} else {
+				require.Empty(t, rec.Header().Get("Content-Security-Policy"))
+				require.Empty(t, rec.Header().Get("X-Frame-Options"))
+			}
+		})
+	}
+}
+
+func TestIndexTrailingDot(t *testing.T) {
+	t.Parallel()
+
+	var upstreamHost string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHost = r.Host
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	for _, host := range []string{"test.onion.zwiebel", "test.onion.zwiebel."} {
+		upstreamHost = ""
+
+		logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+		cfg := config.Config{
+			Domain:  ".onion.zwiebel",
+			Timeout: 1 * time.Minute,
+		}
+		e := echo.New()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = host
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		require.NoError(t, handlers.NewIndexHandler(logger, cfg, newTestTransport(srv), stats.Noop{}).Handler(c))
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, "test.onion", upstreamHost)
+	}
+}
+
+func TestIndexMixedCase(t *testing.T) {
+	t.Parallel()
+
+	var upstreamHost string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHost = r.Host
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	// the configured domain and the host header are compared case insensitive
+	for _, host := range []string{"test.onion.zwiebel", "Test.ONION.Zwiebel", "TEST.Onion.Zwiebel."} {
+		upstreamHost = ""
+
+		logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+		cfg := config.Config{
+			Domain:  ".Onion.Zwiebel",
+			Timeout: 1 * time.Minute,
+		}
+		e := echo.New()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = host
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		require.NoError(t, handlers.NewIndexHandler(logger, cfg, newTestTransport(srv), stats.Noop{}).Handler(c))
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, "test.onion", upstreamHost)
+	}
+
+	// the landing page is shown for the top domain in any case
+	upstreamHost = ""
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cfg := config.Config{
+		Domain:  ".Onion.Zwiebel",
+		Timeout: 1 * time.Minute,
+	}
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "ONION.zwiebel"
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	require.NoError(t, handlers.NewIndexHandler(logger, cfg, newTestTransport(srv), stats.Noop{}).Handler(c))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Empty(t, upstreamHost)
+}
+
+// newTestTransport returns a transport that sends all requests to the test server
+func newTestTransport(srv *httptest.Server) *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, srv.Listener.Addr().String())
+		},
+	}
+}
+
+func TestIndexRequestDeadline(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer srv.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cfg := config.Config{
+		Domain:          ".onion.zwiebel",
+		Timeout:         1 * time.Minute,
+		RequestDeadline: 200 * time.Millisecond,
+	}
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "test.onion.zwiebel"
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	start := time.Now()
+	require.NoError(t, handlers.NewIndexHandler(logger, cfg, newTestTransport(srv), stats.Noop{}).Handler(c))
+	require.Less(t, time.Since(start), 2*time.Second)
+	require.Equal(t, http.StatusBadGateway, rec.Code)
+	require.Equal(t, handlers.ErrorCodeTimeout, rec.Header().Get(handlers.ErrorCodeHeader))
+}
+
+func TestIndexMethods(t *testing.T) {
+	t.Parallel()
+
+	var upstreamMethod string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamMethod = r.Method
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name           string
+		method         string
+		host           string
+		body           string
+		expectedCode   int
+		expectedMethod string
+	}{
+		{"get top domain", http.MethodGet, "onion.zwiebel", "", http.StatusOK, ""},
+		{"head top domain", http.MethodHead, "onion.zwiebel", "", http.StatusOK, ""},
+		{"post top domain", http.MethodPost, "onion.zwiebel", "test", http.StatusMethodNotAllowed, ""},
+		{"get top domain with body", http.MethodGet, "onion.zwiebel", "test", http.StatusBadRequest, ""},
+		{"post onion", http.MethodPost, "test.onion.zwiebel", "test", http.StatusOK, http.MethodPost},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			upstreamMethod = ""
+
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			cfg := config.Config{
+				Domain:  ".onion.zwiebel",
+				Timeout: 1 * time.Minute,
+			}
+			e := echo.New()
+			req := httptest.NewRequest(tt.method, "/", strings.NewReader(tt.body))
+			req.Host = tt.host
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			err := handlers.NewIndexHandler(logger, cfg, newTestTransport(srv), stats.Noop{}).Handler(c)
+			var httpErr *echo.HTTPError
+			if errors.As(err, &httpErr) {
+				require.Equal(t, tt.expectedCode, httpErr.Code)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tt.expectedCode, rec.Code)
+			}
+			require.Equal(t, tt.expectedMethod, upstreamMethod)
+		})
+	}
+}
+
+func TestIndexOnionOffline(t *testing.T) {
+	t.Parallel()
+
+	// fake tor proxy answering every connect with "onion service descriptor can not be found"
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// greeting without authentication
+		if _, err := io.ReadFull(conn, make([]byte, 3)); err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte{0x05, 0x00})
+		// connect request with a domain name
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, make([]byte, int(header[4])+2)); err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte{0x05, 0xF0, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	}()
+
+	dial, err := tor.NewProxyDialContext(&url.URL{Scheme: "socks5h", Host: l.Addr().String()}, tor.NewDialer(5*time.Second, -1))
+	require.NoError(t, err)
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cfg := config.Config{
+		Domain:  ".onion.zwiebel",
+		Timeout: 1 * time.Minute,
+	}
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "test.onion.zwiebel"
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	require.NoError(t, handlers.NewIndexHandler(logger, cfg, &http.Transport{DialContext: dial}, stats.Noop{}).Handler(c))
+	require.Equal(t, http.StatusBadGateway, rec.Code)
+	require.Contains(t, rec.Body.String(), "This onion service is offline or does not exist.")
+	require.Equal(t, handlers.ErrorCodeOnionOffline, rec.Header().Get(handlers.ErrorCodeHeader))
+}
+
+func TestIndexResponseJitter(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	const (
+		jitter   = 100 * time.Millisecond
+		requests = 5
+	)
+
+	tests := []struct {
+		name         string
+		jitter       time.Duration
+		fail         bool
+		expectedCode int
+	}{
+		{"disabled", 0, false, http.StatusOK},
+		{"enabled", jitter, false, http.StatusOK},
+		{"disabled error", 0, true, http.StatusBadGateway},
+		// errors are delayed too so the timing does not reveal the outcome
+		{"enabled error", jitter, true, http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			cfg := config.Config{
+				Domain:         ".onion.zwiebel",
+				Timeout:        1 * time.Minute,
+				ResponseJitter: tt.jitter,
+			}
+			tr := newTestTransport(srv)
+			if tt.fail {
+				tr.DialContext = func(context.Context, string, string) (net.Conn, error) {
+					return nil, errors.New("connection refused")
+				}
+			}
+			h := handlers.NewIndexHandler(logger, cfg, tr, stats.Noop{})
+
+			var total time.Duration
+			for range requests {
+				e := echo.New()
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.Host = "test.onion.zwiebel"
+				rec := httptest.NewRecorder()
+				c := e.NewContext(req, rec)
+				start := time.Now()
+				require.NoError(t, h.Handler(c))
+				took := time.Since(start)
+				require.Equal(t, tt.expectedCode, rec.Code)
+				// allow some slack for the request itself
+				require.Less(t, took, jitter+50*time.Millisecond)
+				total += took
+			}
+
+			if tt.jitter > 0 {
+				// the random delays average to half of the jitter
+				require.Greater(t, total, jitter/2)
+			} else {
+				require.Less(t, total, jitter/2)
+			}
+		})
+	}
+}
+
+func TestIndexConcurrentHosts(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// not rewritten so the host is returned as received
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write([]byte(r.Host))
+	}))
+	defer srv.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cfg := config.Config{
+		Domain:  ".onion.zwiebel",
+		Timeout: 1 * time.Minute,
+	}
+	h := handlers.NewIndexHandler(logger, cfg, newTestTransport(srv), stats.Noop{})
+
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			onion := fmt.Sprintf("host%d", i)
+			e := echo.New()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = fmt.Sprintf("%s.onion.zwiebel", onion)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			assert.NoError(t, h.Handler(c))
+			assert.Equal(t, http.StatusOK, rec.Code)
+			// the upstream received the onion of this request
+			assert.Equal(t, fmt.Sprintf("%s.onion", onion), rec.Body.String())
+		}()
+	}
+	wg.Wait()
+}
+
+func BenchmarkIndexHandler(b *testing.B) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(`<a href="http://najngkjsdngsdngskjgnskjngdfg.onion/test">link</a>`))
+	}))
+	defer srv.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cfg := config.Config{
+		Domain:  ".onion.zwiebel",
+		Timeout: 1 * time.Minute,
+	}
+	h := handlers.NewIndexHandler(logger, cfg, newTestTransport(srv), stats.Noop{})
+	e := echo.New()
+
+	b.ResetTimer()
+	for range b.N {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = "test.onion.zwiebel"
+		rec := httptest.NewRecorder()
+		if err := h.Handler(e.NewContext(req, rec)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestIndexTrailers(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(`<a href="http://najngkjsdngsdngskjgnskjngdfg.onion/test">link</a>`))
+		w.Header().Set("X-Checksum", "1234")
+	}))
+	defer srv.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cfg := config.Config{
+		Domain:  ".onion.zwiebel",
+		Timeout: 1 * time.Minute,
+	}
+	e := echo.New()
+	e.Any("/*", handlers.NewIndexHandler(logger, cfg, newTestTransport(srv), stats.Noop{}).Handler)
+	proxy := httptest.NewServer(e)
+	defer proxy.Close()
+
+	req, err := http.NewRequest(http.MethodGet, proxy.URL, nil)
+	require.NoError(t, err)
+	req.Host = "test.onion.zwiebel"
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, string(body), "najngkjsdngsdngskjgnskjngdfg.onion.zwiebel/test")
+	// trailers are available after the body was read
+	require.Equal(t, "1234", resp.Trailer.Get("X-Checksum"))
+}
+
+func TestIndexNoCacheHeaders(t *testing.T) {
+	t.Parallel()
+
+	var cacheControl, pragma string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cacheControl = r.Header.Get("Cache-Control")
+		pragma = r.Header.Get("Pragma")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cfg := config.Config{
+		Domain:  ".onion.zwiebel",
+		Timeout: 1 * time.Minute,
+	}
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "test.onion.zwiebel"
+	req.Header.Set("Cache-Control", "no-cache")
+	req.Header.Set("Pragma", "no-cache")
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	require.NoError(t, handlers.NewIndexHandler(logger, cfg, newTestTransport(srv), stats.Noop{}).Handler(c))
+	require.Equal(t, http.StatusOK, rec.Code)
+	// the proxy does not cache responses so the onion needs to see the headers
+	require.Equal(t, "no-cache", cacheControl)
+	require.Equal(t, "no-cache", pragma)
+}
+
+func TestIndexRange(t *testing.T) {
+	t.Parallel()
+
+	content := `<a href="http://najngkjsdngsdngskjgnskjngdfg.onion/test">link</a>`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		http.ServeContent(w, r, "index.html", time.Time{}, strings.NewReader(content))
+	}))
+	defer srv.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cfg := config.Config{
+		Domain:  ".onion.zwiebel",
+		Timeout: 1 * time.Minute,
+	}
+	e := echo.New()
+	e.Any("/*", handlers.NewIndexHandler(logger, cfg, newTestTransport(srv), stats.Noop{}).Handler)
+	proxy := httptest.NewServer(e)
+	defer proxy.Close()
+
+	req, err := http.NewRequest(http.MethodGet, proxy.URL, nil)
+	require.NoError(t, err)
+	req.Host = "test.onion.zwiebel"
+	req.Header.Set("Range", "bytes=9-55")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	require.Equal(t, fmt.Sprintf("bytes 9-55/%d", len(content)), resp.Header.Get("Content-Range"))
+	require.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+	require.Equal(t, "47", resp.Header.Get("Content-Length"))
+	// the range is passed through without rewriting
+	require.Equal(t, content[9:56], string(body))
+}
+
+func TestIndexProxyErrorPage(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(`<html><head><title>503 - Forwarding failure (Privoxy@localhost)</title></head>` +
+			`<body><h2>Privoxy was unable to socks5t-forward your request <a href="http://najngkjsdngsdngskjgnskjngdfg.onion/">http://najngkjsdngsdngskjgnskjngdfg.onion/</a></h2></body></html>`))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name         string
+		markers      []string
+		expectedCode int
+		expectedBody string
+	}{
+		{"detected", tor.DefaultProxyErrorMarkers, http.StatusBadGateway, "the proxy returned an error page"},
+		{"disabled", nil, http.StatusServiceUnavailable, "Forwarding failure"},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			cfg := config.Config{
+				Domain:            ".onion.zwiebel",
+				Timeout:           1 * time.Minute,
+				ProxyErrorMarkers: tt.markers,
+			}
+			e := echo.New()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = "test.onion.zwiebel"
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			require.NoError(t, handlers.NewIndexHandler(logger, cfg, newTestTransport(srv), stats.Noop{}).Handler(c))
+			require.Equal(t, tt.expectedCode, rec.Code)
+			require.Contains(t, rec.Body.String(), tt.expectedBody)
+			if tt.markers != nil {
+				require.Equal(t, handlers.ErrorCodeProxyErrorPage, rec.Header().Get(handlers.ErrorCodeHeader))
+			}
+		})
+	}
+}
+
+func TestIndexBlacklisted(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html>some secretword content</html>"))
+	}))
+	defer srv.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cfg := config.Config{
+		Domain:           ".onion.zwiebel",
+		Timeout:          1 * time.Minute,
+		BlacklistedWords: "secretword",
+	}
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "test.onion.zwiebel"
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	require.NoError(t, handlers.NewIndexHandler(logger, cfg, newTestTransport(srv), stats.Noop{}).Handler(c))
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	require.Equal(t, handlers.ErrorCodeBlacklisted, rec.Header().Get(handlers.ErrorCodeHeader))
+	require.Contains(t, rec.Body.String(), "blocked by the operator")
+	// the matched word is not leaked to the user
+	require.NotContains(t, rec.Body.String(), "secretword")
+}
+
+func TestIndexEarlyHints(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Link", "<http://najngkjsdngsdngskjgnskjngdfg.onion/style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Del("Link")
+		w.Header().Set("Content-Type", "text/html")
+		status := http.StatusOK
+		switch r.URL.Path {
+		case "/missing":
+			status = http.StatusNotFound
+		case "/redirect":
+			w.Header().Set("Location", "http://najngkjsdngsdngskjgnskjngdfg.onion/")
+			status = http.StatusFound
+		}
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte("<html>onion</html>"))
+	}))
+	defer srv.Close()
+
+	links := []string{"<http://najngkjsdngsdngskjgnskjngdfg.onion.zwiebel/style.css>; rel=preload; as=style"}
+	tests := []struct {
+		name           string
+		drop           bool
+		path           string
+		expectedLinks  []string
+		expectedStatus int
+	}{
+		{"rewrite", false, "/", links, http.StatusOK},
+		{"drop", true, "/", nil, http.StatusOK},
+		{"not found", false, "/missing", links, http.StatusNotFound},
+		{"redirect", false, "/redirect", links, http.StatusFound},
+		{"drop not found", true, "/missing", nil, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			cfg := config.Config{
+				Domain:         ".onion.zwiebel",
+				Timeout:        1 * time.Minute,
+				DropEarlyHints: tt.drop,
+			}
+			e := echo.New()
+			e.Any("/*", handlers.NewIndexHandler(logger, cfg, newTestTransport(srv), stats.Noop{}).Handler)
+			proxy := httptest.NewServer(e)
+			defer proxy.Close()
+
+			var links []string
+			trace := &httptrace.ClientTrace{
+				Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+					if code == http.StatusEarlyHints {
+						links = append(links, header.Values("Link")...)
+					}
+					return nil
+				},
+			}
+			req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, proxy.URL+tt.path, nil)
+			require.NoError(t, err)
+			req.Host = "test.onion.zwiebel"
+			// the final status is checked so redirects are not followed
+			client := http.Client{
+				CheckRedirect: func(*http.Request, []*http.Request) error {
+					return http.ErrUseLastResponse
+				},
+			}
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+			require.Equal(t, tt.expectedLinks, links)
+			// the final response does not contain the early hints
+			require.Empty(t, resp.Header.Values("Link"))
+		})
+	}
+}
+
+func TestIndexConnectionHeaders(t *testing.T) {
+	t.Parallel()
+
+	var upstreamHeader http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeader = r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cfg := config.Config{
+		Domain:  ".onion.zwiebel",
+		Timeout: 1 * time.Minute,
+	}
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "test.onion.zwiebel"
+	req.Header.Set("Connection", "keep-alive, X-Custom")
+	req.Header.Set("X-Custom", "hop-by-hop")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("X-Other", "end-to-end")
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	require.NoError(t, handlers.NewIndexHandler(logger, cfg, newTestTransport(srv), stats.Noop{}).Handler(c))
+	require.Equal(t, http.StatusOK, rec.Code)
+	// headers listed in Connection are only meant for the proxy
+	require.Empty(t, upstreamHeader.Get("X-Custom"))
+	require.Empty(t, upstreamHeader.Get("Keep-Alive"))
+	require.NotContains(t, upstreamHeader.Get("Connection"), "X-Custom")
+	require.Equal(t, "end-to-end", upstreamHeader.Get("X-Other"))
+}
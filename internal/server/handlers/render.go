@@ -1,10 +1,19 @@
 package handlers
 
 import (
+	"net/http"
+
 	"github.com/a-h/templ"
 	"github.com/labstack/echo/v4"
 )
 
+// DenyFraming prevents the pages served by the proxy itself from being
+// framed by other sites to protect against clickjacking
+func DenyFraming(h http.Header) {
+	h.Set("Content-Security-Policy", "frame-ancestors 'none'")
+	h.Set("X-Frame-Options", "DENY")
+}
+
 func Render(c echo.Context, statusCode int, t templ.Component) error {
 	buf := templ.GetBuffer()
 	defer templ.ReleaseBuffer(buf)
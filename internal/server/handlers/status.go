@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/firefart/zwiebelproxy/internal/stats"
+	"github.com/labstack/echo/v4"
+)
+
+// torDialTimeout is the time to wait for the tor proxy to accept a connection
+const torDialTimeout = 2 * time.Second
+
+type StatusHandler struct {
+	logger   *slog.Logger
+	counter  *stats.Counter
+	torProxy string
+	start    time.Time
+	version  string
+}
+
+type Status struct {
+	UptimeSeconds float64 `json:"uptime_seconds"`
+	Version       string  `json:"version"`
+	InFlight      int64   `json:"in_flight_requests"`
+	Requests      int64   `json:"requests_total"`
+	Errors        int64   `json:"errors_total"`
+	Blocked       int64   `json:"blocked_total"`
+	TorReady      bool    `json:"tor_ready"`
+}
+
+// NewStatusHandler creates the status handler. torProxy is the host:port of the
+// tor socks proxy and is used to check if tor accepts connections
+func NewStatusHandler(logger *slog.Logger, counter *stats.Counter, torProxy string) *StatusHandler {
+	version := "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		version = info.Main.Version
+	}
+
+	return &StatusHandler{
+		logger:   logger,
+		counter:  counter,
+		torProxy: torProxy,
+		start:    time.Now(),
+		version:  version,
+	}
+}
+
+func (h *StatusHandler) Handler(c echo.Context) error {
+	return c.JSON(http.StatusOK, Status{
+		UptimeSeconds: time.Since(h.start).Seconds(),
+		Version:       h.version,
+		InFlight:      h.counter.InFlight(),
+		Requests:      h.counter.Requests(),
+		Errors:        h.counter.Errors(),
+		Blocked:       h.counter.Blocks(),
+		TorReady:      h.torReady(c),
+	})
+}
+
+func (h *StatusHandler) torReady(c echo.Context) bool {
+	if h.torProxy == "" {
+		return false
+	}
+	d := net.Dialer{Timeout: torDialTimeout}
+	conn, err := d.DialContext(c.Request().Context(), "tcp", h.torProxy)
+	if err != nil {
+		h.logger.Debug("tor proxy not reachable", slog.String("tor", h.torProxy), slog.String("err", err.Error()))
+		return false
+	}
+	conn.Close()
+	return true
+}
@@ -2,15 +2,24 @@ package server
 
 import (
 	"context"
+	"crypto/subtle"
 	"fmt"
 	"log/slog"
+	"math"
 	"net"
 	"net/http"
 	"net/netip"
 	"strings"
 
+	"github.com/firefart/zwiebelproxy/internal/tor"
+	"github.com/firefart/zwiebelproxy/internal/tracing"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func (s *server) middlewareRecover() echo.MiddlewareFunc {
@@ -35,6 +44,11 @@ func (s *server) middlewareRequestLogger(ctx context.Context) echo.MiddlewareFun
 		LogError:         true,
 		HandleError:      true, // forwards error to the global error handler, so it can decide appropriate status code
 		LogValuesFunc: func(c echo.Context, v middleware.RequestLoggerValues) error {
+			s.stats.IncRequest()
+			s.stats.ObserveLatency(v.Latency)
+			s.stats.ObserveResponseSize(v.ResponseSize)
+			s.stats.ObserveStatus(v.Status)
+
 			logLevel := slog.LevelInfo
 			errString := ""
 			// only set error on real errors
@@ -58,6 +72,40 @@ func (s *server) middlewareRequestLogger(ctx context.Context) echo.MiddlewareFun
 	})
 }
 
+func (s *server) inFlightMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		s.counter.IncInFlight()
+		defer s.counter.DecInFlight()
+		return next(c)
+	}
+}
+
+func (s *server) tracingMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		r := c.Request()
+		// honor an inbound traceparent header
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracing.Tracer().Start(ctx, "proxy request",
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("server.address", r.Host),
+				attribute.String("url.path", r.URL.Path),
+			),
+		)
+		defer span.End()
+
+		c.SetRequest(r.WithContext(ctx))
+		err := next(c)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", c.Response().Status))
+		return err
+	}
+}
+
 func (s *server) xHeaderMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		r := c.Request()
@@ -101,13 +149,66 @@ func (s *server) xHeaderMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
+// forwardedMiddleware applies the protocol and host of a RFC 7239 Forwarded header.
+// Only the element added by the trusted proxy closest to the client is used.
+func (s *server) forwardedMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		r := c.Request()
+		f := forwardedElement(r, s.trustedProxies)
+		if f == nil {
+			return next(c)
+		}
+		if proto := strings.ToLower(f["proto"]); proto == "http" || proto == "https" {
+			r.URL.Scheme = proto
+		}
+		if host := f["host"]; host != "" {
+			r.Host = host
+		}
+		return next(c)
+	}
+}
+
+// userAgentMiddleware blocks requests from the configured user agents
+func (s *server) userAgentMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userAgent := c.Request().UserAgent()
+		for _, re := range s.blockedAgents {
+			if re.MatchString(userAgent) {
+				s.logger.Error("blocked user agent", slog.String("remote-ip", c.RealIP()), slog.String("user-agent", userAgent), slog.String("matched", re.String()))
+				return echo.NewHTTPError(http.StatusForbidden, "access denied")
+			}
+		}
+		return next(c)
+	}
+}
+
 func (s *server) ipAuthMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
+		if s.bypassValue != "" {
+			value := c.Request().Header.Get(s.bypassHeader)
+			// never send the secret to the onion
+			c.Request().Header.Del(s.bypassHeader)
+			if subtle.ConstantTimeCompare([]byte(value), []byte(s.bypassValue)) == 1 {
+				s.logger.Info("allowing client with bypass header", slog.String("ip", c.RealIP()))
+				return next(c)
+			}
+		}
+
 		if len(s.allowedHosts) == 0 && len(s.allowedIPs) == 0 && len(s.allowedIPRanges) == 0 {
 			// configured as a public server, no ip checks
 			return next(c)
 		}
 
+		// the landing page can be public even if proxying is restricted
+		if s.landingPublic && s.isTopDomain(c.Request()) {
+			return next(c)
+		}
+
+		// load balancers probing the health checks are not in the allowlist
+		if (c.Path() == "/healthz" || c.Path() == "/readyz") && s.isTopDomain(c.Request()) {
+			return next(c)
+		}
+
 		r := c.Request()
 
 		ip := c.RealIP()
@@ -141,23 +242,141 @@ func (s *server) ipAuthMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 			}
 		}
 
-		for _, d := range s.allowedHosts {
-			dynamicIP, err := s.dnsClient.IPLookup(r.Context(), d)
+		var lookupErr error
+		if len(s.allowedHosts) > 0 {
+			// resolve the hosts in parallel so many allowed hosts do not add up the lookup times
+			d, err := s.dnsClient.MatchIP(r.Context(), s.allowedHosts, remoteIP, s.maxHostLookups)
+			if d != "" {
+				s.logger.Info("allowing client", slog.String("ip", remoteIP), slog.String("hostname", d))
+				return next(c)
+			}
+			lookupErr = err
+		}
+
+		// the cached ip of a dynamic dns host might be outdated
+		if s.revalidate && len(s.allowedHosts) > 0 {
+			d, ok, err := s.dnsClient.RevalidateIP(r.Context(), s.allowedHosts, remoteIP, s.maxHostLookups)
+			if d != "" {
+				s.logger.Info("allowing client after revalidation", slog.String("ip", remoteIP), slog.String("hostname", d))
+				return next(c)
+			}
+			if err != nil {
+				s.logger.Error("could not revalidate allowed hosts", slog.String("err", err.Error()))
+			} else if ok {
+				s.logger.Debug("revalidated allowed hosts", slog.String("ip", remoteIP))
+			}
+		}
+
+		// the failed lookup is only reported if the revalidation did not match either
+		if lookupErr != nil {
+			s.logger.Error("invalid domain in config", slog.String("err", lookupErr.Error()))
+			return echo.NewHTTPError(http.StatusInternalServerError, "internal error")
+		}
+
+		s.logger.Error("access denied", slog.String("remote-ip", remoteIP))
+		return echo.NewHTTPError(http.StatusForbidden, "access denied")
+	}
+}
+
+// isolationMiddleware adds a random isolation token to the request context so
+// the connections of each request are made over a separate tor circuit
+func (s *server) isolationMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := tor.NewIsolationToken()
+		if err != nil {
+			return fmt.Errorf("could not create isolation token: %w", err)
+		}
+		r := c.Request()
+		c.SetRequest(r.WithContext(tor.WithIsolationToken(r.Context(), token)))
+		return next(c)
+	}
+}
+
+// shedMiddleware rejects requests to onions while the upstream error rate is too high
+func (s *server) shedMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if s.isTopDomain(c.Request()) {
+			return next(c)
+		}
+		remaining, ok := s.shedder.shedding()
+		if !ok {
+			return next(c)
+		}
+		s.stats.IncShed()
+		c.Response().Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(remaining.Seconds()))))
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "The onion services are currently failing, please try again later.")
+	}
+}
+
+// connLimitMiddleware limits the number of concurrent requests per client ip
+func (s *server) connLimitMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ip := c.RealIP()
+		remoteIP, _, err := net.SplitHostPort(ip)
+		if err != nil {
+			remoteIP = ip
+		}
+		remoteIP = strings.TrimSpace(remoteIP)
+
+		if !s.connLimiter.acquire(remoteIP) {
+			s.logger.Error("too many concurrent requests", slog.String("remote-ip", remoteIP))
+			return echo.NewHTTPError(http.StatusTooManyRequests, "too many concurrent requests")
+		}
+		defer s.connLimiter.release(remoteIP)
+		return next(c)
+	}
+}
+
+// topDomainMiddleware passes requests to other hosts than the top domain to the fallback handler
+func (s *server) topDomainMiddleware(fallback echo.HandlerFunc) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !s.isTopDomain(c.Request()) {
+				return fallback(c)
+			}
+			return next(c)
+		}
+	}
+}
+
+// adminMiddleware only allows requests to the top domain from the admin ip ranges.
+// Requests to other hosts are passed to the fallback handler.
+func (s *server) adminMiddleware(fallback echo.HandlerFunc) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !s.isTopDomain(c.Request()) {
+				return fallback(c)
+			}
+
+			ip := c.RealIP()
+			remoteIP, _, err := net.SplitHostPort(ip)
+			if err != nil {
+				remoteIP = ip
+			}
+			ipParsed, err := netip.ParseAddr(strings.TrimSpace(remoteIP))
 			if err != nil {
-				s.logger.Error("invalid domain in config", slog.String("domain", d), slog.String("err", err.Error()))
-				return echo.NewHTTPError(http.StatusInternalServerError, "internal error")
+				return echo.NewHTTPError(http.StatusBadRequest, "could not determine remote ip")
 			}
 
-			s.logger.Debug("dns resolved", slog.String("host", d), slog.String("ips", strings.Join(dynamicIP, ", ")))
-			for _, i := range dynamicIP {
-				if i == remoteIP {
-					s.logger.Info("allowing client", slog.String("ip", remoteIP), slog.String("hostname", d))
+			for _, prefix := range s.adminIPRanges {
+				if prefix.Contains(ipParsed.Unmap()) {
 					return next(c)
 				}
 			}
+
+			s.logger.Error("admin access denied", slog.String("remote-ip", remoteIP))
+			return echo.NewHTTPError(http.StatusForbidden, "access denied")
 		}
+	}
+}
 
-		s.logger.Error("access denied", slog.String("remote-ip", remoteIP))
-		return echo.NewHTTPError(http.StatusForbidden, "access denied")
+// isTopDomain returns true if the request is sent to the proxy domain itself
+// and not to an onion
+func (s *server) isTopDomain(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		// no port present
+		host = r.Host
 	}
+	return strings.EqualFold(strings.TrimSuffix(host, "."), s.domain)
 }
@@ -4,70 +4,174 @@ import (
 	"context"
 	"log/slog"
 	"net/http"
+	"net/http/pprof"
 	"net/netip"
-	"time"
+	"regexp"
+	"strings"
 
+	"github.com/firefart/zwiebelproxy/internal/config"
 	"github.com/firefart/zwiebelproxy/internal/dns"
 	"github.com/firefart/zwiebelproxy/internal/server/handlers"
+	"github.com/firefart/zwiebelproxy/internal/server/templates"
+	"github.com/firefart/zwiebelproxy/internal/stats"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	// LandingAccessPublic shows the landing page to all clients
+	LandingAccessPublic = "public"
+	// LandingAccessRestricted only shows the landing page to allowed clients
+	LandingAccessRestricted = "restricted"
 )
 
 type server struct {
 	logger          *slog.Logger
+	domain          string
+	stats           stats.Stats
+	counter         *stats.Counter
 	dnsClient       *dns.DnsClient
 	allowedHosts    []string
+	maxHostLookups  int
+	revalidate      bool
 	allowedIPs      []string
 	allowedIPRanges []netip.Prefix
+	adminIPRanges   []netip.Prefix
+	trustedProxies  []netip.Prefix
+	landingPublic   bool
+	blockedAgents   []*regexp.Regexp
+	errorTemplate   templates.Template
+	allowFraming    bool
+	connLimiter     *connLimiter
+	shedder         *loadShedder
+	auditLogger     *slog.Logger
+	// requests with the bypass header skip the ip checks, disabled if the value is empty
+	bypassHeader string
+	bypassValue  string
 }
 
-func NewServer(ctx context.Context,
-	logger *slog.Logger,
-	cloudflare bool,
-	revProxy bool,
-	debug bool,
-	domain string,
-	blacklistedWords string,
-	secretKeyHeaderName string,
-	secretKeyHeaderValue string,
-	timeout time.Duration,
-	dnsCacheTimeout time.Duration,
-	allowedHosts []string,
-	allowedIPs []string,
-	allowedIPRanges []netip.Prefix,
-	transport *http.Transport,
-) http.Handler {
+// NewServer creates the http handler. If st is nil all stats are discarded
+func NewServer(ctx context.Context, logger *slog.Logger, cfg config.Config, transport *http.Transport, st stats.Stats) http.Handler {
+	if st == nil {
+		st = stats.Noop{}
+	}
+
+	// the name is validated on startup so fall back to the default on errors
+	errorTemplate, err := templates.Get(cfg.ErrorTemplate)
+	if err != nil {
+		errorTemplate = templates.Index
+	}
+	errorTemplate = templates.WithCSS(errorTemplate, cfg.PageCSS)
+
+	// keep own counters for the status page
+	counter := &stats.Counter{}
+	multi := stats.Multi{st, counter}
+	var shedder *loadShedder
+	if cfg.ShedErrorPercent > 0 {
+		shedder = newLoadShedder(logger, cfg.ShedErrorPercent, cfg.ShedMinRequests, cfg.ShedWindow, cfg.ShedCooldown)
+		multi = append(multi, shedder)
+	}
+
 	s := server{
 		logger:          logger,
-		dnsClient:       dns.NewDNSClient(timeout, dnsCacheTimeout),
-		allowedHosts:    allowedHosts,
-		allowedIPs:      allowedIPs,
-		allowedIPRanges: allowedIPRanges,
+		domain:          strings.ToLower(strings.TrimLeft(cfg.Domain, ".")),
+		stats:           multi,
+		counter:         counter,
+		dnsClient:       dns.NewDNSClient(cfg.Timeout, cfg.DNSCacheTimeout, cfg.DNSNegativeTimeout, cfg.DNSCacheMaxEntries, cfg.Resolver),
+		allowedHosts:    cfg.AllowedHosts,
+		maxHostLookups:  cfg.MaxHostLookups,
+		revalidate:      cfg.RevalidateOnDeny,
+		allowedIPs:      cfg.AllowedIPs,
+		allowedIPRanges: cfg.AllowedIPRanges,
+		adminIPRanges:   cfg.AdminIPRanges,
+		trustedProxies:  cfg.TrustedProxyRanges,
+		landingPublic:   cfg.LandingAccess == LandingAccessPublic,
+		blockedAgents:   cfg.BlockedAgents,
+		errorTemplate:   errorTemplate,
+		allowFraming:    cfg.AllowFraming,
+		shedder:         shedder,
+		auditLogger:     cfg.AuditLogger,
+		bypassHeader:    http.CanonicalHeaderKey(cfg.BypassHeaderName),
+		bypassValue:     cfg.BypassHeaderValue,
 	}
 
 	e := echo.New()
 	e.HideBanner = true
-	e.Debug = debug
+	e.Debug = cfg.Debug
 	e.HTTPErrorHandler = s.customHTTPErrorHandler
 
-	if cloudflare {
+	if cfg.Cloudflare {
 		e.IPExtractor = extractIPFromCloudflareHeader()
-	} else if revProxy {
+	} else if cfg.RevProxy {
 		e.IPExtractor = echo.ExtractIPFromXFFHeader()
+	} else if cfg.TrustForwarded {
+		e.IPExtractor = extractIPFromForwardedHeader(cfg.TrustedProxyRanges)
 	} else {
 		e.IPExtractor = echo.ExtractIPDirect()
 	}
 
 	e.Use(s.middlewareRequestLogger(ctx))
+	e.Use(s.inFlightMiddleware)
+	e.Use(s.tracingMiddleware)
 	e.Use(middleware.Secure())
 	// use forwarding proxy port and schema information
 	e.Use(s.xHeaderMiddleware)
+	if cfg.TrustForwarded {
+		e.Use(s.forwardedMiddleware)
+	}
+	if len(cfg.BlockedAgents) > 0 {
+		e.Use(s.userAgentMiddleware)
+	}
 	e.Use(s.ipAuthMiddleware)
+	if s.shedder != nil {
+		e.Use(s.shedMiddleware)
+	}
+	if cfg.MaxConnsPerIP > 0 {
+		s.connLimiter = newConnLimiter(cfg.MaxConnsPerIP)
+		e.Use(s.connLimitMiddleware)
+	}
 	e.Use(s.middlewareRecover())
+	if cfg.IsolateRequests {
+		e.Use(s.isolationMiddleware)
+	}
+	if cfg.MaxRequestBody != "" {
+		e.Use(middleware.BodyLimit(cfg.MaxRequestBody))
+	}
+
+	secretKeyHeaderName := http.CanonicalHeaderKey(cfg.SecretKeyHeaderName)
+	e.GET("/test/panic", handlers.NewPanicHandler(s.logger, cfg.Debug, secretKeyHeaderName, cfg.SecretKeyHeaderValue).Handler)
+
+	indexHandler := handlers.NewIndexHandler(s.logger, cfg, transport, s.stats)
+	indexHandler.WatchBlacklist(ctx)
+
+	if cfg.Debug || cfg.EnablePprof {
+		// only served on the top domain, requests to onions are passed to the index handler
+		g := e.Group("/debug/pprof", s.adminMiddleware(indexHandler.Handler))
+		g.GET("/*", echo.WrapHandler(http.HandlerFunc(pprof.Index)))
+		g.GET("/cmdline", echo.WrapHandler(http.HandlerFunc(pprof.Cmdline)))
+		g.GET("/profile", echo.WrapHandler(http.HandlerFunc(pprof.Profile)))
+		g.GET("/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+		g.POST("/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+		g.GET("/trace", echo.WrapHandler(http.HandlerFunc(pprof.Trace)))
+	}
+
+	// the metrics are registered on the default registry by the caller
+	if cfg.EnableMetrics {
+		e.Any("/metrics", echo.WrapHandler(promhttp.Handler()), s.adminMiddleware(indexHandler.Handler))
+	}
+
+	// only served on the top domain, requests to onions are passed to the index handler
+	e.Any("/status", handlers.NewStatusHandler(s.logger, s.counter, cfg.TorProxy).Handler, s.adminMiddleware(indexHandler.Handler))
 
-	secretKeyHeaderName = http.CanonicalHeaderKey(secretKeyHeaderName)
-	e.GET("/test/panic", handlers.NewPanicHandler(s.logger, debug, secretKeyHeaderName, secretKeyHeaderValue).Handler)
+	// the health checks are used by load balancers so they are exempted from the
+	// ip allowlist in the ipAuthMiddleware and not restricted to the admin ip ranges
+	healthHandler := handlers.NewHealthHandler(s.logger, cfg.DrainGrace, cfg.OnDrained, cfg.TorProxy, cfg.Timeout)
+	e.Any("/healthz", healthHandler.Handler, s.topDomainMiddleware(indexHandler.Handler))
+	e.Any("/readyz", healthHandler.ReadyHandler, s.topDomainMiddleware(indexHandler.Handler))
+	e.Any("/admin/drain", healthHandler.DrainHandler, s.adminMiddleware(indexHandler.Handler))
 
-	e.GET("/*", handlers.NewIndexHandler(s.logger, debug, domain, blacklistedWords, transport, timeout).Handler)
+	// onion services can receive all methods, the top domain is checked in the handler
+	e.Any("/*", indexHandler.Handler)
 	return e
 }
@@ -0,0 +1,1164 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/firefart/zwiebelproxy/internal/config"
+	"github.com/firefart/zwiebelproxy/internal/server"
+	"github.com/firefart/zwiebelproxy/internal/server/handlers"
+	"github.com/firefart/zwiebelproxy/internal/stats"
+	"github.com/firefart/zwiebelproxy/internal/tor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// newTestTransport returns a transport that sends all requests to the test server
+func newTestTransport(srv *httptest.Server) *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, srv.Listener.Addr().String())
+		},
+	}
+}
+
+func newTestConfig() config.Config {
+	return config.Config{
+		Domain:          ".onion.zwiebel",
+		Timeout:         1 * time.Minute,
+		DNSCacheTimeout: 1 * time.Minute,
+	}
+}
+
+func TestMaxRequestBody(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name          string
+		body          string
+		contentLength int64
+		expectedCode  int
+	}{
+		{"small body", strings.Repeat("A", 10), 10, http.StatusOK},
+		{"oversized body", strings.Repeat("A", 2048), 2048, http.StatusRequestEntityTooLarge},
+		{"oversized streaming body", strings.Repeat("A", 2048), -1, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			cfg := newTestConfig()
+			cfg.MaxRequestBody = "1K"
+			s := server.NewServer(context.Background(), logger, cfg, newTestTransport(srv), nil)
+
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			req.Host = "test.onion.zwiebel"
+			req.ContentLength = tt.contentLength
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			require.Equal(t, tt.expectedCode, rec.Code)
+		})
+	}
+}
+
+type fakeStats struct {
+	requests  atomic.Int64
+	latencies atomic.Int64
+	sizes     atomic.Int64
+	statuses  atomic.Int64
+	upstreams atomic.Int64
+	errors    atomic.Int64
+	upErrors  atomic.Int64
+	blocks    atomic.Int64
+	shed      atomic.Int64
+}
+
+func (f *fakeStats) IncRequest()                          { f.requests.Add(1) }
+func (f *fakeStats) ObserveLatency(time.Duration)         { f.latencies.Add(1) }
+func (f *fakeStats) ObserveResponseSize(int64)            { f.sizes.Add(1) }
+func (f *fakeStats) ObserveStatus(int)                    { f.statuses.Add(1) }
+func (f *fakeStats) ObserveUpstreamLatency(time.Duration) { f.upstreams.Add(1) }
+func (f *fakeStats) IncError()                            { f.errors.Add(1) }
+func (f *fakeStats) IncUpstreamError()                    { f.upErrors.Add(1) }
+func (f *fakeStats) IncBlock()                            { f.blocks.Add(1) }
+func (f *fakeStats) IncShed()                             { f.shed.Add(1) }
+
+func TestStats(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		if r.URL.Path == "/blocked" {
+			_, _ = w.Write([]byte("<html>blocked</html>"))
+			return
+		}
+		_, _ = w.Write([]byte("<html>test</html>"))
+	}))
+	defer srv.Close()
+
+	closedSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closedSrv.Close()
+
+	tests := []struct {
+		name             string
+		server           *httptest.Server
+		path             string
+		expectedRequests int64
+		expectedErrors   int64
+		expectedBlocks   int64
+	}{
+		{"request", srv, "/", 1, 0, 0},
+		{"blocked", srv, "/blocked", 1, 0, 1},
+		{"error", closedSrv, "/", 1, 1, 0},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			cfg := newTestConfig()
+			cfg.BlacklistedWords = "blocked"
+			st := &fakeStats{}
+			s := server.NewServer(context.Background(), logger, cfg, newTestTransport(tt.server), st)
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Host = "test.onion.zwiebel"
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			require.Equal(t, tt.expectedRequests, st.requests.Load())
+			require.Equal(t, tt.expectedRequests, st.latencies.Load())
+			require.Equal(t, tt.expectedRequests, st.sizes.Load())
+			require.Equal(t, tt.expectedRequests, st.statuses.Load())
+			require.Equal(t, tt.expectedRequests, st.upstreams.Load())
+			require.Equal(t, tt.expectedErrors, st.errors.Load())
+			require.Equal(t, tt.expectedBlocks, st.blocks.Load())
+		})
+	}
+}
+
+// not run in parallel as it modifies the global tracer provider
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html>test</html>"))
+	}))
+	defer srv.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	s := server.NewServer(context.Background(), logger, newTestConfig(), newTestTransport(srv), nil)
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodGet, "/test", nil)
+	req.Host = "test.onion.zwiebel"
+	req.Header.Set("traceparent", fmt.Sprintf("00-%s-00f067aa0ba902b7-01", traceID))
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	require.Contains(t, spans, "proxy request")
+	require.Contains(t, spans, "upstream request")
+	require.Contains(t, spans, "rewrite response")
+
+	proxySpan := spans["proxy request"]
+	require.Equal(t, traceID, proxySpan.SpanContext.TraceID().String())
+	require.Contains(t, proxySpan.Attributes, attribute.String("server.address", "test.onion.zwiebel"))
+	require.Contains(t, proxySpan.Attributes, attribute.Int("http.response.status_code", http.StatusOK))
+
+	upstreamSpan := spans["upstream request"]
+	require.Equal(t, traceID, upstreamSpan.SpanContext.TraceID().String())
+	require.Contains(t, upstreamSpan.Attributes, attribute.String("server.address", "test.onion"))
+}
+
+func TestPprof(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html>onion</html>"))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name          string
+		enabled       bool
+		host          string
+		adminIPRanges []netip.Prefix
+		expectedCode  int
+		expectedBody  string
+	}{
+		// the top domain shows the info page on all paths
+		{"disabled", false, "onion.zwiebel", []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}, http.StatusOK, "ZWIEBELPROXY"},
+		{"enabled", true, "onion.zwiebel", []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}, http.StatusOK, "goroutine"},
+		{"enabled with port", true, "onion.zwiebel:8080", []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}, http.StatusOK, "goroutine"},
+		{"enabled not admin", true, "onion.zwiebel", []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, http.StatusForbidden, ""},
+		{"enabled onion", true, "test.onion.zwiebel", []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}, http.StatusOK, "onion"},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			cfg := newTestConfig()
+			cfg.EnablePprof = tt.enabled
+			cfg.AdminIPRanges = tt.adminIPRanges
+			s := server.NewServer(context.Background(), logger, cfg, newTestTransport(srv), nil)
+
+			// the remote address of test requests is 192.0.2.1
+			req := httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil)
+			req.Host = tt.host
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			require.Equal(t, tt.expectedCode, rec.Code)
+			require.Contains(t, rec.Body.String(), tt.expectedBody)
+			if !tt.enabled || tt.expectedCode != http.StatusOK {
+				require.NotContains(t, rec.Body.String(), "goroutine")
+			}
+		})
+	}
+}
+
+func TestStatus(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html>onion</html>"))
+	}))
+	defer srv.Close()
+
+	// fake tor proxy only accepting connections
+	tor, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer tor.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cfg := newTestConfig()
+	cfg.TorProxy = tor.Addr().String()
+	cfg.AdminIPRanges = []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}
+	s := server.NewServer(context.Background(), logger, cfg, newTestTransport(srv), nil)
+
+	getStatus := func() map[string]any {
+		// the remote address of test requests is 192.0.2.1
+		req := httptest.NewRequest(http.MethodGet, "/status", nil)
+		req.Host = "onion.zwiebel"
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var status map[string]any
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+		for _, field := range []string{"uptime_seconds", "version", "in_flight_requests", "requests_total", "errors_total", "blocked_total", "tor_ready"} {
+			require.Contains(t, status, field)
+		}
+		return status
+	}
+
+	first := getStatus()
+	require.Equal(t, true, first["tor_ready"])
+	// the status request itself is in flight
+	require.InDelta(t, 1, first["in_flight_requests"], 0)
+
+	// requests to onions are still proxied
+	req := httptest.NewRequest(http.MethodPost, "/status", nil)
+	req.Host = "test.onion.zwiebel"
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "onion")
+
+	time.Sleep(10 * time.Millisecond)
+	second := getStatus()
+	require.Greater(t, second["uptime_seconds"], first["uptime_seconds"])
+	require.Greater(t, second["requests_total"], first["requests_total"])
+
+	// access is restricted to the admin ip ranges
+	req = httptest.NewRequest(http.MethodGet, "/status", nil)
+	req.Host = "onion.zwiebel"
+	req.RemoteAddr = "10.0.0.1:1234"
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+}
+
+func TestTemplates(t *testing.T) {
+	t.Parallel()
+
+	closedSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closedSrv.Close()
+
+	const (
+		defaultMarker = "<h1>ZWIEBELPROXY</h1>"
+		minimalMarker = "<p>"
+	)
+
+	tests := []struct {
+		name            string
+		landingTemplate string
+		errorTemplate   string
+		host            string
+		expectedCode    int
+		expected        string
+		notExpected     string
+	}{
+		{"default landing", "", "minimal", "onion.zwiebel", http.StatusOK, defaultMarker, minimalMarker},
+		{"minimal landing", "minimal", "default", "onion.zwiebel", http.StatusOK, "<p>Zwiebelproxy</p>", defaultMarker},
+		{"minimal error", "default", "minimal", "test.example.com", http.StatusBadRequest, minimalMarker, defaultMarker},
+		{"default error", "minimal", "default", "test.example.com", http.StatusBadRequest, defaultMarker, minimalMarker},
+		{"minimal proxy error", "default", "minimal", "test.onion.zwiebel", http.StatusBadGateway, minimalMarker, defaultMarker},
+		{"default proxy error", "minimal", "", "test.onion.zwiebel", http.StatusBadGateway, defaultMarker, minimalMarker},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			cfg := newTestConfig()
+			cfg.LandingTemplate = tt.landingTemplate
+			cfg.ErrorTemplate = tt.errorTemplate
+			s := server.NewServer(context.Background(), logger, cfg, newTestTransport(closedSrv), nil)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = tt.host
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			require.Equal(t, tt.expectedCode, rec.Code)
+			require.Contains(t, rec.Body.String(), tt.expected)
+			require.NotContains(t, rec.Body.String(), tt.notExpected)
+		})
+	}
+}
+
+func TestForwarded(t *testing.T) {
+	t.Parallel()
+
+	var upstreamHost string
+	var upstreamTLS bool
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHost = r.Host
+		upstreamTLS = r.TLS != nil
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	plainSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHost = r.Host
+		upstreamTLS = r.TLS != nil
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer plainSrv.Close()
+
+	tests := []struct {
+		name           string
+		trustForwarded bool
+		server         *httptest.Server
+		forwarded      string
+		remoteAddr     string
+		allowedIPs     []string
+		expectedCode   int
+		expectedHost   string
+		expectedTLS    bool
+	}{
+		{"trusted", true, srv, `proto=https;host=foo.onion.zwiebel`, "", nil, http.StatusOK, "foo.onion", true},
+		{"trusted quoted", true, srv, `for=192.0.2.43, For="[2001:db8:cafe::17]:4711";Proto=HTTPS;Host="foo.onion.zwiebel"`, "", nil, http.StatusOK, "foo.onion", true},
+		{"untrusted", false, plainSrv, `proto=https;host=foo.onion.zwiebel`, "", nil, http.StatusOK, "test.onion", false},
+		{"trusted client ip", true, plainSrv, `for=198.51.100.17`, "10.0.0.1:1234", []string{"198.51.100.17"}, http.StatusOK, "test.onion", false},
+		{"untrusted client ip", false, plainSrv, `for=198.51.100.17`, "10.0.0.1:1234", []string{"198.51.100.17"}, http.StatusForbidden, "", false},
+		// elements sent by the client are in front of the element of the proxy
+		{"spoofed client ip", true, plainSrv, `for=127.0.0.1, for=198.51.100.17`, "10.0.0.1:1234", []string{"127.0.0.1"}, http.StatusForbidden, "", false},
+		{"spoofed client ip header line", true, plainSrv, "for=127.0.0.1\nfor=198.51.100.17", "10.0.0.1:1234", []string{"127.0.0.1"}, http.StatusForbidden, "", false},
+		{"spoofed host", true, plainSrv, `proto=https;host=foo.onion.zwiebel, for=198.51.100.17`, "", nil, http.StatusOK, "test.onion", false},
+		{"trusted proxy chain", true, plainSrv, `for=198.51.100.17, for=10.0.0.2`, "10.0.0.1:1234", []string{"198.51.100.17"}, http.StatusOK, "test.onion", false},
+		{"untrusted proxy", true, plainSrv, `for=198.51.100.17`, "198.51.100.1:1234", []string{"198.51.100.17"}, http.StatusForbidden, "", false},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			upstreamHost = ""
+			upstreamTLS = false
+
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			cfg := newTestConfig()
+			cfg.TrustForwarded = tt.trustForwarded
+			cfg.TrustedProxyRanges = []netip.Prefix{netip.MustParsePrefix("192.0.2.1/32"), netip.MustParsePrefix("10.0.0.0/8")}
+			cfg.AllowedIPs = tt.allowedIPs
+			tr := newTestTransport(tt.server)
+			tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+			s := server.NewServer(context.Background(), logger, cfg, tr, nil)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = "test.onion.zwiebel"
+			// multiple header lines are separated by a newline
+			for _, line := range strings.Split(tt.forwarded, "\n") {
+				req.Header.Add("Forwarded", line)
+			}
+			if tt.remoteAddr != "" {
+				req.RemoteAddr = tt.remoteAddr
+			}
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			require.Equal(t, tt.expectedCode, rec.Code)
+			require.Equal(t, tt.expectedHost, upstreamHost)
+			require.Equal(t, tt.expectedTLS, upstreamTLS)
+		})
+	}
+}
+
+func TestErrorCodeHeader(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		if r.URL.Path == "/blocked" {
+			_, _ = w.Write([]byte("<html>blocked</html>"))
+			return
+		}
+		_, _ = w.Write([]byte("<html>test</html>"))
+	}))
+	defer srv.Close()
+
+	closedSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closedSrv.Close()
+
+	tests := []struct {
+		name         string
+		server       *httptest.Server
+		host         string
+		path         string
+		body         string
+		expectedCode string
+	}{
+		{"success", srv, "test.onion.zwiebel", "/", "", ""},
+		{"blacklisted", srv, "test.onion.zwiebel", "/blocked", "", "blacklisted"},
+		{"upstream error", closedSrv, "test.onion.zwiebel", "/", "", "upstream_error"},
+		{"invalid domain", srv, "test.example.com", "/", "", "bad_request"},
+		{"oversized body", srv, "test.onion.zwiebel", "/", strings.Repeat("A", 2048), "request_too_large"},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			cfg := newTestConfig()
+			cfg.BlacklistedWords = "blocked"
+			cfg.MaxRequestBody = "1K"
+			s := server.NewServer(context.Background(), logger, cfg, newTestTransport(tt.server), nil)
+
+			req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			req.Host = tt.host
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			require.Equal(t, tt.expectedCode, rec.Header().Get("X-Zwiebel-Error"))
+		})
+	}
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	t.Parallel()
+
+	arrived := make(chan struct{})
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			arrived <- struct{}{}
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cfg := newTestConfig()
+	cfg.MaxConnsPerIP = 2
+	s := server.NewServer(context.Background(), logger, cfg, newTestTransport(srv), nil)
+
+	serve := func(path, remoteAddr string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Host = "test.onion.zwiebel"
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// block the maximum number of requests for one ip in the upstream
+	codes := make(chan int, cfg.MaxConnsPerIP)
+	for range cfg.MaxConnsPerIP {
+		go func() {
+			codes <- serve("/block", "192.0.2.1:1234")
+		}()
+		<-arrived
+	}
+
+	require.Equal(t, http.StatusTooManyRequests, serve("/", "192.0.2.1:5678"))
+	// other ips are not affected
+	require.Equal(t, http.StatusOK, serve("/", "192.0.2.2:1234"))
+
+	close(release)
+	for range cfg.MaxConnsPerIP {
+		require.Equal(t, http.StatusOK, <-codes)
+	}
+
+	// the slots are freed after the requests finished
+	require.Equal(t, http.StatusOK, serve("/", "192.0.2.1:5678"))
+}
+
+func TestIsolateRequests(t *testing.T) {
+	t.Parallel()
+
+	for _, isolate := range []bool{true, false} {
+		isolate := isolate
+		t.Run(fmt.Sprint(isolate), func(t *testing.T) {
+			t.Parallel()
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer srv.Close()
+
+			tokens := make(chan string, 2)
+			tr := &http.Transport{
+				DisableKeepAlives: true,
+				DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+					tokens <- tor.IsolationToken(ctx)
+					var d net.Dialer
+					return d.DialContext(ctx, network, srv.Listener.Addr().String())
+				},
+			}
+
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			cfg := newTestConfig()
+			cfg.IsolateRequests = isolate
+			s := server.NewServer(context.Background(), logger, cfg, tr, nil)
+
+			for range 2 {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.Host = "test.onion.zwiebel"
+				rec := httptest.NewRecorder()
+				s.ServeHTTP(rec, req)
+				require.Equal(t, http.StatusOK, rec.Code)
+			}
+
+			first, second := <-tokens, <-tokens
+			if isolate {
+				require.NotEmpty(t, first)
+				require.NotEqual(t, first, second)
+			} else {
+				require.Empty(t, first)
+				require.Empty(t, second)
+			}
+		})
+	}
+}
+
+func TestLandingPageAccess(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name         string
+		access       string
+		host         string
+		remoteAddr   string
+		expectedCode int
+	}{
+		{"restricted allowed ip", server.LandingAccessRestricted, "onion.zwiebel", "192.0.2.1:1234", http.StatusOK},
+		{"restricted denied ip", server.LandingAccessRestricted, "onion.zwiebel", "192.0.2.2:1234", http.StatusForbidden},
+		{"public allowed ip", server.LandingAccessPublic, "onion.zwiebel", "192.0.2.1:1234", http.StatusOK},
+		{"public denied ip", server.LandingAccessPublic, "onion.zwiebel", "192.0.2.2:1234", http.StatusOK},
+		{"public denied ip with port", server.LandingAccessPublic, "onion.zwiebel:8080", "192.0.2.2:1234", http.StatusOK},
+		{"public denied ip onion", server.LandingAccessPublic, "test.onion.zwiebel", "192.0.2.2:1234", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			cfg := newTestConfig()
+			cfg.AllowedIPs = []string{"192.0.2.1"}
+			cfg.LandingAccess = tt.access
+			s := server.NewServer(context.Background(), logger, cfg, newTestTransport(srv), nil)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = tt.host
+			req.RemoteAddr = tt.remoteAddr
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			require.Equal(t, tt.expectedCode, rec.Code)
+		})
+	}
+}
+
+func TestLoadShedding(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name           string
+		fail           bool
+		upstreamStatus int
+		// clientErrors sends an oversized body after every proxied request
+		clientErrors bool
+		// dnsErrors sends a request failing on the allowed hosts lookup after every proxied request
+		dnsErrors    bool
+		expectedCode int
+	}{
+		{"high error rate", true, http.StatusOK, false, false, http.StatusServiceUnavailable},
+		{"upstream 5xx", false, http.StatusBadGateway, false, false, http.StatusServiceUnavailable},
+		{"no errors", false, http.StatusOK, false, false, http.StatusOK},
+		{"client errors", false, http.StatusOK, true, false, http.StatusOK},
+		{"dns errors", false, http.StatusOK, false, true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.Copy(io.Discard, r.Body)
+				w.WriteHeader(tt.upstreamStatus)
+			}))
+			defer srv.Close()
+			tr := newTestTransport(srv)
+			if tt.fail {
+				// simulate an unreachable tor proxy
+				tr.DialContext = func(context.Context, string, string) (net.Conn, error) {
+					return nil, fmt.Errorf("connection refused")
+				}
+			}
+
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			cfg := newTestConfig()
+			cfg.ShedErrorPercent = 50
+			cfg.ShedMinRequests = 4
+			cfg.ShedWindow = 1 * time.Minute
+			cfg.ShedCooldown = 1 * time.Minute
+			cfg.MaxRequestBody = "1K"
+			// requests without the bypass header fail with a 500 on the dns lookup
+			cfg.AllowedHosts = []string{"unknown.example.com"}
+			cfg.Resolver = &fakeResolver{}
+			cfg.BypassHeaderName = "x-bypass-key"
+			cfg.BypassHeaderValue = "secret"
+			st := &fakeStats{}
+			s := server.NewServer(context.Background(), logger, cfg, tr, st)
+
+			serve := func(host string, bypass bool) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.Host = host
+				if bypass {
+					req.Header.Set("X-Bypass-Key", "secret")
+				}
+				rec := httptest.NewRecorder()
+				s.ServeHTTP(rec, req)
+				return rec
+			}
+
+			for range cfg.ShedMinRequests {
+				serve("test.onion.zwiebel", true)
+				if tt.clientErrors {
+					req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("A", 2048)))
+					req.Host = "test.onion.zwiebel"
+					req.Header.Set("X-Bypass-Key", "secret")
+					req.ContentLength = -1
+					rec := httptest.NewRecorder()
+					s.ServeHTTP(rec, req)
+					require.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+				}
+				if tt.dnsErrors {
+					require.Equal(t, http.StatusInternalServerError, serve("test.onion.zwiebel", false).Code)
+				}
+			}
+			rec := serve("test.onion.zwiebel", true)
+			require.Equal(t, tt.expectedCode, rec.Code)
+			if tt.expectedCode == http.StatusServiceUnavailable {
+				require.Equal(t, "60", rec.Header().Get("Retry-After"))
+				require.Equal(t, int64(1), st.shed.Load())
+			} else {
+				require.Equal(t, int64(0), st.shed.Load())
+			}
+			// the top domain is still served
+			require.Equal(t, http.StatusOK, serve("onion.zwiebel", true).Code)
+		})
+	}
+}
+
+func TestBypassHeader(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the secret must not reach the onion
+		if r.Header.Get("X-Bypass-Key") != "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name         string
+		value        string
+		remoteAddr   string
+		expectedCode int
+	}{
+		{"correct value", "secret", "192.0.2.2:1234", http.StatusOK},
+		{"wrong value", "wrong", "192.0.2.2:1234", http.StatusForbidden},
+		{"missing header denied ip", "", "192.0.2.2:1234", http.StatusForbidden},
+		{"missing header allowed ip", "", "192.0.2.1:1234", http.StatusOK},
+		{"wrong value allowed ip", "wrong", "192.0.2.1:1234", http.StatusOK},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			cfg := newTestConfig()
+			cfg.AllowedIPs = []string{"192.0.2.1"}
+			cfg.BypassHeaderName = "x-bypass-key"
+			cfg.BypassHeaderValue = "secret"
+			s := server.NewServer(context.Background(), logger, cfg, newTestTransport(srv), nil)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = "test.onion.zwiebel"
+			req.RemoteAddr = tt.remoteAddr
+			if tt.value != "" {
+				req.Header.Set("X-Bypass-Key", tt.value)
+			}
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			require.Equal(t, tt.expectedCode, rec.Code)
+		})
+	}
+}
+
+// fakeResolver resolves the hosts from a static map
+type fakeResolver struct {
+	hosts map[string][]string
+	calls atomic.Int32
+	// failFirst fails the first lookup like a temporary dns outage
+	failFirst bool
+}
+
+func (f *fakeResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	n := f.calls.Add(1)
+	addrs, ok := f.hosts[host]
+	if !ok || (f.failFirst && n == 1) {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+func TestAllowedHosts(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name         string
+		allowedHosts []string
+		remoteAddr   string
+		failFirst    bool
+		revalidate   bool
+		expectedCode int
+	}{
+		{"resolves to client", []string{"home.example.com"}, "192.0.2.1:1234", false, false, http.StatusOK},
+		{"second host resolves to client", []string{"unknown.example.com", "office.example.com"}, "192.0.2.2:1234", false, false, http.StatusOK},
+		{"resolves to other ip", []string{"home.example.com"}, "192.0.2.3:1234", false, false, http.StatusForbidden},
+		{"not resolvable", []string{"unknown.example.com"}, "192.0.2.1:1234", false, false, http.StatusInternalServerError},
+		{"failed lookup", []string{"home.example.com"}, "192.0.2.1:1234", true, false, http.StatusInternalServerError},
+		// the revalidation runs before the failed lookup is reported
+		{"failed lookup revalidated", []string{"home.example.com"}, "192.0.2.1:1234", true, true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer srv.Close()
+
+			resolver := &fakeResolver{hosts: map[string][]string{
+				"home.example.com":   {"192.0.2.1"},
+				"office.example.com": {"2001:db8::1", "192.0.2.2"},
+			}, failFirst: tt.failFirst}
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			cfg := newTestConfig()
+			cfg.AllowedHosts = tt.allowedHosts
+			cfg.MaxHostLookups = 1
+			cfg.Resolver = resolver
+			cfg.RevalidateOnDeny = tt.revalidate
+			s := server.NewServer(context.Background(), logger, cfg, newTestTransport(srv), nil)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = "test.onion.zwiebel"
+			req.RemoteAddr = tt.remoteAddr
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			require.Equal(t, tt.expectedCode, rec.Code)
+			expectedCalls := len(tt.allowedHosts)
+			if tt.revalidate {
+				expectedCalls *= 2
+			}
+			require.Equal(t, int32(expectedCalls), resolver.calls.Load())
+		})
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	t.Parallel()
+
+	// fake tor proxy answering the SOCKS5 greeting
+	tor, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer tor.Close()
+	go func() {
+		for {
+			conn, err := tor.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = io.ReadFull(conn, make([]byte, 3))
+			_, _ = conn.Write([]byte{0x05, 0x00})
+			conn.Close()
+		}
+	}()
+
+	// closed port
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	downAddr := down.Addr().String()
+	require.NoError(t, down.Close())
+
+	// accepts connections but never answers the SOCKS5 greeting
+	hang, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer hang.Close()
+	go func() {
+		for {
+			conn, err := hang.Accept()
+			if err != nil {
+				return
+			}
+			// keep the connection open until the test ends
+			defer conn.Close()
+		}
+	}()
+
+	tests := []struct {
+		name         string
+		torProxy     string
+		expectedCode int
+		expected     handlers.Readiness
+	}{
+		{"tor up", tor.Addr().String(), http.StatusOK, handlers.Readiness{Ready: true}},
+		{"tor down", downAddr, http.StatusServiceUnavailable, handlers.Readiness{Ready: false}},
+		{"tor hangs", hang.Addr().String(), http.StatusServiceUnavailable, handlers.Readiness{Ready: false}},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			cfg := newTestConfig()
+			cfg.TorProxy = tt.torProxy
+			// the readiness check uses a shorter timeout than the requests
+			cfg.Timeout = 1 * time.Minute
+			s := server.NewServer(context.Background(), logger, cfg, &http.Transport{}, nil)
+
+			req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+			req.Host = "onion.zwiebel"
+			rec := httptest.NewRecorder()
+			start := time.Now()
+			s.ServeHTTP(rec, req)
+			require.Less(t, time.Since(start), 10*time.Second)
+			require.Equal(t, tt.expectedCode, rec.Code)
+
+			var readiness handlers.Readiness
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &readiness))
+			require.Equal(t, tt.expected.Ready, readiness.Ready)
+			if !tt.expected.Ready {
+				require.Contains(t, readiness.Reason, "tor proxy not reachable")
+			}
+		})
+	}
+}
+
+func TestHealthAllowlist(t *testing.T) {
+	t.Parallel()
+
+	// closed port so the readiness check fails without a tor proxy
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	downAddr := down.Addr().String()
+	require.NoError(t, down.Close())
+
+	tests := []struct {
+		name         string
+		host         string
+		path         string
+		expectedCode int
+	}{
+		{"healthz", "onion.zwiebel", "/healthz", http.StatusOK},
+		{"readyz", "onion.zwiebel", "/readyz", http.StatusServiceUnavailable},
+		{"landing page", "onion.zwiebel", "/", http.StatusForbidden},
+		{"healthz on onion", "test.onion.zwiebel", "/healthz", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			cfg := newTestConfig()
+			cfg.AllowedIPs = []string{"192.0.2.1"}
+			cfg.TorProxy = downAddr
+			cfg.Timeout = 5 * time.Second
+			s := server.NewServer(context.Background(), logger, cfg, &http.Transport{}, nil)
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Host = tt.host
+			req.RemoteAddr = "192.0.2.2:1234"
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			require.Equal(t, tt.expectedCode, rec.Code)
+		})
+	}
+}
+
+func TestDrain(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html>onion</html>"))
+	}))
+	defer srv.Close()
+
+	drained := make(chan struct{})
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cfg := newTestConfig()
+	cfg.AdminIPRanges = []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}
+	cfg.DrainGrace = 200 * time.Millisecond
+	cfg.OnDrained = func() { close(drained) }
+	s := server.NewServer(context.Background(), logger, cfg, newTestTransport(srv), nil)
+
+	// the remote address of test requests is 192.0.2.1
+	serve := func(method, host, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Host = host
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	require.Equal(t, http.StatusOK, serve(http.MethodGet, "onion.zwiebel", "/healthz").Code)
+	require.Equal(t, http.StatusMethodNotAllowed, serve(http.MethodGet, "onion.zwiebel", "/admin/drain").Code)
+
+	// onions might use the same paths
+	rec := serve(http.MethodPost, "test.onion.zwiebel", "/admin/drain")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "onion")
+
+	require.Equal(t, http.StatusAccepted, serve(http.MethodPost, "onion.zwiebel", "/admin/drain").Code)
+	require.Equal(t, http.StatusServiceUnavailable, serve(http.MethodGet, "onion.zwiebel", "/healthz").Code)
+
+	// requests are still served during the grace period
+	rec = serve(http.MethodGet, "test.onion.zwiebel", "/")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "onion")
+	rec = serve(http.MethodGet, "test.onion.zwiebel", "/healthz")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "onion")
+
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "server was not shut down after the grace period")
+	}
+}
+
+func TestBlockedUserAgents(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name         string
+		userAgent    string
+		expectedCode int
+	}{
+		{"allowed", "Mozilla/5.0 (Windows NT 10.0; rv:128.0) Gecko/20100101 Firefox/128.0", http.StatusOK},
+		{"substring", "Mozilla/5.0 (compatible; Nmap Scripting Engine)", http.StatusForbidden},
+		{"substring case insensitive", "sqlmap/1.8", http.StatusForbidden},
+		{"regex", "curl/8.5.0", http.StatusForbidden},
+		{"regex no match", "libcurl-agent/1.0", http.StatusOK},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			cfg := newTestConfig()
+			cfg.BlockedAgents = []*regexp.Regexp{
+				regexp.MustCompile(`(?i)nmap`),
+				regexp.MustCompile(`(?i)SQLMap`),
+				regexp.MustCompile(`^curl/`),
+			}
+			s := server.NewServer(context.Background(), logger, cfg, newTestTransport(srv), nil)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = "test.onion.zwiebel"
+			req.Header.Set("User-Agent", tt.userAgent)
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			require.Equal(t, tt.expectedCode, rec.Code)
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html>onion</html>"))
+	}))
+	defer srv.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cfg := newTestConfig()
+	cfg.EnableMetrics = true
+	cfg.AdminIPRanges = []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}
+	// the metrics handler serves the default registry
+	st, err := stats.NewPrometheus(prometheus.DefaultRegisterer, nil, nil)
+	require.NoError(t, err)
+	s := server.NewServer(context.Background(), logger, cfg, newTestTransport(srv), st)
+
+	// the remote address of test requests is 192.0.2.1
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Host = "onion.zwiebel"
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "go_goroutines")
+
+	// requests to onions are still proxied
+	req = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Host = "test.onion.zwiebel"
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "onion")
+
+	req = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Host = "onion.zwiebel"
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	for _, name := range []string{
+		"zwiebelproxy_requests_total",
+		`zwiebelproxy_responses_total{class="2xx"}`,
+		"zwiebelproxy_blocked_total",
+		"zwiebelproxy_upstream_duration_seconds",
+	} {
+		require.Contains(t, rec.Body.String(), name)
+	}
+
+	// access is restricted to the admin ip ranges
+	req = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Host = "onion.zwiebel"
+	req.RemoteAddr = "10.0.0.1:1234"
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+}
+
+func TestAuditLog(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		if r.URL.Path == "/blocked" {
+			_, _ = w.Write([]byte("<html>forbidden</html>"))
+			return
+		}
+		_, _ = w.Write([]byte("<html>onion</html>"))
+	}))
+	defer srv.Close()
+
+	var audit bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cfg := newTestConfig()
+	cfg.AllowedIPs = []string{"10.0.0.1"}
+	cfg.BlacklistedWords = "forbidden"
+	cfg.AuditLogger = slog.New(slog.NewJSONHandler(&audit, nil))
+	s := server.NewServer(context.Background(), logger, cfg, newTestTransport(srv), nil)
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		path         string
+		expectedCode int
+		reason       string
+		target       string
+	}{
+		{"allowed", "10.0.0.1:1234", "/", http.StatusOK, "", ""},
+		{"denied ip", "192.0.2.1:1234", "/", http.StatusForbidden, "access denied", "test.onion.zwiebel/"},
+		// blocked responses are logged with the onion as target
+		{"blacklisted", "10.0.0.1:1234", "/blocked", http.StatusForbidden, "blacklisted word", "test.onion/blocked"},
+	}
+	for _, tt := range tests {
+		audit.Reset()
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		req.Host = "test.onion.zwiebel"
+		req.RemoteAddr = tt.remoteAddr
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		require.Equal(t, tt.expectedCode, rec.Code, tt.name)
+		if tt.reason == "" {
+			require.Empty(t, audit.String(), tt.name)
+			continue
+		}
+		var line map[string]string
+		require.NoError(t, json.Unmarshal(audit.Bytes(), &line), tt.name)
+		require.Equal(t, "request denied", line["msg"])
+		require.Equal(t, strings.Split(tt.remoteAddr, ":")[0], line["ip"])
+		require.Contains(t, line["reason"], tt.reason)
+		require.Equal(t, tt.target, line["target"])
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/firefart/zwiebelproxy/internal/stats"
+)
+
+// loadShedder tracks the upstream error rate and rejects requests for the
+// cooldown once the error rate of a window exceeded the threshold. It is
+// added to the stats of the server to receive the upstream requests and errors.
+// Other errors like failed dns lookups of the allowed hosts are not counted.
+type loadShedder struct {
+	stats.Noop
+	logger      *slog.Logger
+	percent     int
+	minRequests int
+	window      time.Duration
+	cooldown    time.Duration
+
+	mu          sync.Mutex
+	windowStart time.Time
+	requests    int
+	errors      int
+	shedUntil   time.Time
+}
+
+func newLoadShedder(logger *slog.Logger, percent, minRequests int, window, cooldown time.Duration) *loadShedder {
+	return &loadShedder{
+		logger:      logger,
+		percent:     percent,
+		minRequests: minRequests,
+		window:      window,
+		cooldown:    cooldown,
+	}
+}
+
+// ObserveUpstreamLatency is called after every request to an onion
+func (l *loadShedder) ObserveUpstreamLatency(time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if l.sheddingLocked(now) {
+		return
+	}
+	l.resetExpiredLocked(now)
+	l.requests++
+
+	// the error of a request is counted before its upstream latency
+	if l.requests >= l.minRequests && l.errors*100 >= l.requests*l.percent {
+		l.logger.Warn("high upstream error rate, rejecting requests",
+			slog.Int("requests", l.requests),
+			slog.Int("errors", l.errors),
+			slog.Duration("cooldown", l.cooldown))
+		l.shedUntil = now.Add(l.cooldown)
+		l.requests = 0
+		l.errors = 0
+	}
+}
+
+func (l *loadShedder) IncUpstreamError() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	// the rejected requests are errors too
+	if l.sheddingLocked(now) {
+		return
+	}
+	l.resetExpiredLocked(now)
+	l.errors++
+}
+
+// shedding returns the remaining cooldown if requests should be rejected
+func (l *loadShedder) shedding() (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if !l.sheddingLocked(now) {
+		return 0, false
+	}
+	return l.shedUntil.Sub(now), true
+}
+
+func (l *loadShedder) sheddingLocked(now time.Time) bool {
+	return now.Before(l.shedUntil)
+}
+
+// resetExpiredLocked starts a new window if the current one is over
+func (l *loadShedder) resetExpiredLocked(now time.Time) {
+	if now.Sub(l.windowStart) >= l.window {
+		l.windowStart = now
+		l.requests = 0
+		l.errors = 0
+	}
+}
@@ -29,7 +29,17 @@ func Index(err string) templ.Component {
 			templ_7745c5c3_Var1 = templ.NopComponent
 		}
 		ctx = templ.ClearChildren(ctx)
-		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("<!doctype html><html lang=\"en\"><head><meta charset=\"UTF-8\"><meta http-equiv=\"X-UA-Compatible\" content=\"IE=edge\"><meta name=\"viewport\" content=\"width=device-width, initial-scale=1.0\"><title>Zwiebelproxy</title><style>\n    *, *::before, *::after {\n      box-sizing: border-box;\n      font-family: Gotham Rounded, sans-serif;\n      font-weight: normal;\n    }\n    a {\n      color: #bc6575;\n    }\n    a:link { text-decoration: none; }\n    a:visited { text-decoration: none; }\n    a:hover { text-decoration: underline; }\n\n    body {\n      padding: 0;\n      margin: 0;\n      background-color: #1A1A1D;\n      color: #C3073f;\n    }\n    .container {\n      display: flex;\n      align-items: center;\n      text-align: center;\n      justify-content: center;\n      flex-direction: column;\n      height: 100vh;\n    }\n    h1   {\n      font-weight: bolder;\n      font-size: 10vw;\n    }\n    h5    {\n      font-weight: bolder;\n      font-size: 1vw;\n    }\n    .error {\n      border: 10px solid black;\n      min-width: 80%;\n      padding: 2vh;\n      background-color: #C3073f;\n      color: black;\n      font-weight: bold;\n      font-size: 2em;\n    }\n  </style></head><body><div class=\"container\"><h1>ZWIEBELPROXY</h1>")
+		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("<!doctype html><html lang=\"en\"><head><meta charset=\"UTF-8\"><meta http-equiv=\"X-UA-Compatible\" content=\"IE=edge\"><meta name=\"viewport\" content=\"width=device-width, initial-scale=1.0\"><title>Zwiebelproxy</title><style>\n    *, *::before, *::after {\n      box-sizing: border-box;\n      font-family: Gotham Rounded, sans-serif;\n      font-weight: normal;\n    }\n    a {\n      color: #bc6575;\n    }\n    a:link { text-decoration: none; }\n    a:visited { text-decoration: none; }\n    a:hover { text-decoration: underline; }\n\n    body {\n      padding: 0;\n      margin: 0;\n      background-color: #1A1A1D;\n      color: #C3073f;\n    }\n    .container {\n      display: flex;\n      align-items: center;\n      text-align: center;\n      justify-content: center;\n      flex-direction: column;\n      height: 100vh;\n    }\n    h1   {\n      font-weight: bolder;\n      font-size: 10vw;\n    }\n    h5    {\n      font-weight: bolder;\n      font-size: 1vw;\n    }\n    .error {\n      border: 10px solid black;\n      min-width: 80%;\n      padding: 2vh;\n      background-color: #C3073f;\n      color: black;\n      font-weight: bold;\n      font-size: 2em;\n    }\n  </style>")
+		if templ_7745c5c3_Err != nil {
+			return templ_7745c5c3_Err
+		}
+		if css := customCSS(ctx); css != "" {
+			templ_7745c5c3_Err = templ.Raw("<style>"+css+"</style>").Render(ctx, templ_7745c5c3_Buffer)
+			if templ_7745c5c3_Err != nil {
+				return templ_7745c5c3_Err
+			}
+		}
+		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("</head><body><div class=\"container\"><h1>ZWIEBELPROXY</h1>")
 		if templ_7745c5c3_Err != nil {
 			return templ_7745c5c3_Err
 		}
@@ -41,7 +51,7 @@ func Index(err string) templ.Component {
 			var templ_7745c5c3_Var2 string
 			templ_7745c5c3_Var2, templ_7745c5c3_Err = templ.JoinStringErrs(err)
 			if templ_7745c5c3_Err != nil {
-				return templ.Error{Err: templ_7745c5c3_Err, FileName: `internal/server/templates/default.templ`, Line: 62, Col: 11}
+				return templ.Error{Err: templ_7745c5c3_Err, FileName: `internal/server/templates/default.templ`, Line: 65, Col: 11}
 			}
 			_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString(templ.EscapeString(templ_7745c5c3_Var2))
 			if templ_7745c5c3_Err != nil {
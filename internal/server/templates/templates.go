@@ -0,0 +1,53 @@
+package templates
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/a-h/templ"
+)
+
+// Template renders a page with an optional message
+type Template func(message string) templ.Component
+
+// DefaultTemplate is used if no template name is configured
+const DefaultTemplate = "default"
+
+var available = map[string]Template{
+	DefaultTemplate: Index,
+	"minimal":       Minimal,
+}
+
+// Get returns the template with the given name. An empty name returns the default template.
+func Get(name string) (Template, error) {
+	if name == "" {
+		name = DefaultTemplate
+	}
+	t, ok := available[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown template %q", name)
+	}
+	return t, nil
+}
+
+type cssKey struct{}
+
+// WithCSS returns a template that inlines the custom css into the rendered page.
+// If css is empty the template is returned unchanged.
+func WithCSS(t Template, css string) Template {
+	if css == "" {
+		return t
+	}
+	return func(message string) templ.Component {
+		return templ.ComponentFunc(func(ctx context.Context, w io.Writer) error {
+			return t(message).Render(context.WithValue(ctx, cssKey{}, css), w)
+		})
+	}
+}
+
+// customCSS returns the css set by WithCSS
+func customCSS(ctx context.Context) string {
+	css, _ := ctx.Value(cssKey{}).(string)
+	return css
+}
@@ -0,0 +1,90 @@
+package stats
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Counter keeps the totals in memory so they can be exposed by the server
+type Counter struct {
+	requests atomic.Int64
+	errors   atomic.Int64
+	blocks   atomic.Int64
+	inFlight atomic.Int64
+}
+
+func (c *Counter) IncRequest()                          { c.requests.Add(1) }
+func (c *Counter) ObserveLatency(time.Duration)         {}
+func (c *Counter) ObserveResponseSize(int64)            {}
+func (c *Counter) ObserveStatus(int)                    {}
+func (c *Counter) ObserveUpstreamLatency(time.Duration) {}
+func (c *Counter) IncError()                            { c.errors.Add(1) }
+func (c *Counter) IncUpstreamError()                    {}
+func (c *Counter) IncBlock()                            { c.blocks.Add(1) }
+func (c *Counter) IncShed()                             {}
+
+// IncInFlight and DecInFlight track the requests that are currently processed
+func (c *Counter) IncInFlight() { c.inFlight.Add(1) }
+func (c *Counter) DecInFlight() { c.inFlight.Add(-1) }
+
+func (c *Counter) Requests() int64 { return c.requests.Load() }
+func (c *Counter) Errors() int64   { return c.errors.Load() }
+func (c *Counter) Blocks() int64   { return c.blocks.Load() }
+func (c *Counter) InFlight() int64 { return c.inFlight.Load() }
+
+// Multi sends all values to every contained Stats
+type Multi []Stats
+
+func (m Multi) IncRequest() {
+	for _, s := range m {
+		s.IncRequest()
+	}
+}
+
+func (m Multi) ObserveLatency(d time.Duration) {
+	for _, s := range m {
+		s.ObserveLatency(d)
+	}
+}
+
+func (m Multi) ObserveResponseSize(size int64) {
+	for _, s := range m {
+		s.ObserveResponseSize(size)
+	}
+}
+
+func (m Multi) ObserveStatus(code int) {
+	for _, s := range m {
+		s.ObserveStatus(code)
+	}
+}
+
+func (m Multi) ObserveUpstreamLatency(d time.Duration) {
+	for _, s := range m {
+		s.ObserveUpstreamLatency(d)
+	}
+}
+
+func (m Multi) IncError() {
+	for _, s := range m {
+		s.IncError()
+	}
+}
+
+func (m Multi) IncUpstreamError() {
+	for _, s := range m {
+		s.IncUpstreamError()
+	}
+}
+
+func (m Multi) IncBlock() {
+	for _, s := range m {
+		s.IncBlock()
+	}
+}
+
+func (m Multi) IncShed() {
+	for _, s := range m {
+		s.IncShed()
+	}
+}
@@ -0,0 +1,33 @@
+package stats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCounter(t *testing.T) {
+	t.Parallel()
+
+	c1 := &Counter{}
+	c2 := &Counter{}
+	m := Multi{c1, c2, Noop{}}
+
+	m.IncRequest()
+	m.IncRequest()
+	m.IncError()
+	m.IncBlock()
+	m.ObserveLatency(1 * time.Second)
+	c1.IncInFlight()
+	c1.IncInFlight()
+	c1.DecInFlight()
+
+	for _, c := range []*Counter{c1, c2} {
+		require.Equal(t, int64(2), c.Requests())
+		require.Equal(t, int64(1), c.Errors())
+		require.Equal(t, int64(1), c.Blocks())
+	}
+	require.Equal(t, int64(1), c1.InFlight())
+	require.Equal(t, int64(0), c2.InFlight())
+}
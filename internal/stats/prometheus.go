@@ -0,0 +1,132 @@
+package stats
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultDurationBuckets are the default buckets of the request duration histogram in seconds
+var DefaultDurationBuckets = prometheus.DefBuckets
+
+// DefaultSizeBuckets are the default buckets of the response size histogram in bytes
+var DefaultSizeBuckets = prometheus.ExponentialBuckets(256, 4, 8)
+
+type Prometheus struct {
+	requests  prometheus.Counter
+	responses *prometheus.CounterVec
+	errors    prometheus.Counter
+	upErrors  prometheus.Counter
+	blocks    prometheus.Counter
+	shed      prometheus.Counter
+	latency   prometheus.Histogram
+	upstream  prometheus.Histogram
+	size      prometheus.Histogram
+}
+
+// NewPrometheus registers the metrics on reg. If durationBuckets or
+// sizeBuckets are empty the default buckets are used.
+func NewPrometheus(reg prometheus.Registerer, durationBuckets, sizeBuckets []float64) (*Prometheus, error) {
+	if len(durationBuckets) == 0 {
+		durationBuckets = DefaultDurationBuckets
+	}
+	if len(sizeBuckets) == 0 {
+		sizeBuckets = DefaultSizeBuckets
+	}
+	// the histograms panic on unsorted buckets
+	for _, buckets := range [][]float64{durationBuckets, sizeBuckets} {
+		for i := 1; i < len(buckets); i++ {
+			if buckets[i] <= buckets[i-1] {
+				return nil, fmt.Errorf("histogram buckets must be in increasing order: %v", buckets)
+			}
+		}
+	}
+
+	p := Prometheus{
+		requests: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "zwiebelproxy_requests_total",
+			Help: "Total number of requests",
+		}),
+		responses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "zwiebelproxy_responses_total",
+			Help: "Total number of responses by status class",
+		}, []string{"class"}),
+		errors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "zwiebelproxy_errors_total",
+			Help: "Total number of errors",
+		}),
+		upErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "zwiebelproxy_upstream_errors_total",
+			Help: "Total number of requests to onions that failed or returned a 5xx status",
+		}),
+		blocks: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "zwiebelproxy_blocked_total",
+			Help: "Total number of responses blocked because of blacklisted words",
+		}),
+		shed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "zwiebelproxy_shed_total",
+			Help: "Total number of requests rejected because of a high upstream error rate",
+		}),
+		latency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "zwiebelproxy_request_duration_seconds",
+			Help:    "Duration of requests in seconds",
+			Buckets: durationBuckets,
+		}),
+		upstream: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "zwiebelproxy_upstream_duration_seconds",
+			Help:    "Duration of requests to onions in seconds",
+			Buckets: durationBuckets,
+		}),
+		size: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "zwiebelproxy_response_size_bytes",
+			Help:    "Size of response bodies in bytes",
+			Buckets: sizeBuckets,
+		}),
+	}
+
+	for _, c := range []prometheus.Collector{p.requests, p.responses, p.errors, p.upErrors, p.blocks, p.shed, p.latency, p.upstream, p.size} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return &p, nil
+}
+
+func (p *Prometheus) IncRequest() {
+	p.requests.Inc()
+}
+
+func (p *Prometheus) ObserveLatency(d time.Duration) {
+	p.latency.Observe(d.Seconds())
+}
+
+func (p *Prometheus) ObserveResponseSize(size int64) {
+	p.size.Observe(float64(size))
+}
+
+// ObserveStatus counts the response by the class of the status code like 2xx
+func (p *Prometheus) ObserveStatus(code int) {
+	p.responses.WithLabelValues(fmt.Sprintf("%dxx", code/100)).Inc()
+}
+
+func (p *Prometheus) ObserveUpstreamLatency(d time.Duration) {
+	p.upstream.Observe(d.Seconds())
+}
+
+func (p *Prometheus) IncError() {
+	p.errors.Inc()
+}
+
+func (p *Prometheus) IncUpstreamError() {
+	p.upErrors.Inc()
+}
+
+func (p *Prometheus) IncBlock() {
+	p.blocks.Inc()
+}
+
+func (p *Prometheus) IncShed() {
+	p.shed.Inc()
+}
@@ -0,0 +1,73 @@
+package stats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheus(t *testing.T) {
+	t.Parallel()
+
+	reg := prometheus.NewPedanticRegistry()
+	p, err := NewPrometheus(reg, nil, nil)
+	require.NoError(t, err)
+
+	p.IncRequest()
+	p.IncRequest()
+	p.IncError()
+	p.IncUpstreamError()
+	p.IncBlock()
+	p.IncShed()
+	p.ObserveLatency(1 * time.Second)
+	p.ObserveUpstreamLatency(1 * time.Second)
+	p.ObserveStatus(200)
+	p.ObserveStatus(204)
+	p.ObserveStatus(502)
+
+	require.InDelta(t, 2, testutil.ToFloat64(p.requests), 0)
+	require.InDelta(t, 2, testutil.ToFloat64(p.responses.WithLabelValues("2xx")), 0)
+	require.InDelta(t, 1, testutil.ToFloat64(p.responses.WithLabelValues("5xx")), 0)
+	require.InDelta(t, 1, testutil.ToFloat64(p.errors), 0)
+	require.InDelta(t, 1, testutil.ToFloat64(p.upErrors), 0)
+	require.InDelta(t, 1, testutil.ToFloat64(p.blocks), 0)
+	require.InDelta(t, 1, testutil.ToFloat64(p.shed), 0)
+	count, err := testutil.GatherAndCount(reg, "zwiebelproxy_request_duration_seconds", "zwiebelproxy_upstream_duration_seconds")
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+
+	// registering twice must fail
+	_, err = NewPrometheus(reg, nil, nil)
+	require.Error(t, err)
+}
+
+func TestPrometheusBuckets(t *testing.T) {
+	t.Parallel()
+
+	reg := prometheus.NewPedanticRegistry()
+	p, err := NewPrometheus(reg, []float64{0.5, 5}, []float64{100, 1000, 10000})
+	require.NoError(t, err)
+
+	p.ObserveLatency(1 * time.Second)
+	p.ObserveResponseSize(500)
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	buckets := make(map[string][]float64)
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			for _, b := range m.GetHistogram().GetBucket() {
+				buckets[f.GetName()] = append(buckets[f.GetName()], b.GetUpperBound())
+			}
+		}
+	}
+	require.Equal(t, []float64{0.5, 5}, buckets["zwiebelproxy_request_duration_seconds"])
+	require.Equal(t, []float64{100, 1000, 10000}, buckets["zwiebelproxy_response_size_bytes"])
+
+	// unsorted buckets are rejected
+	_, err = NewPrometheus(prometheus.NewPedanticRegistry(), []float64{5, 0.5}, nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,31 @@
+package stats
+
+import "time"
+
+// Stats is called by the server on requests, errors and blocked responses.
+// Implement this interface to send the values to your own metrics backend.
+type Stats interface {
+	IncRequest()
+	ObserveLatency(d time.Duration)
+	ObserveResponseSize(size int64)
+	ObserveStatus(code int)
+	ObserveUpstreamLatency(d time.Duration)
+	IncError()
+	// IncUpstreamError is called if an onion could not be reached or responded with a 5xx status
+	IncUpstreamError()
+	IncBlock()
+	IncShed()
+}
+
+// Noop discards all values
+type Noop struct{}
+
+func (Noop) IncRequest()                          {}
+func (Noop) ObserveLatency(time.Duration)         {}
+func (Noop) ObserveResponseSize(int64)            {}
+func (Noop) ObserveStatus(int)                    {}
+func (Noop) ObserveUpstreamLatency(time.Duration) {}
+func (Noop) IncError()                            {}
+func (Noop) IncUpstreamError()                    {}
+func (Noop) IncBlock()                            {}
+func (Noop) IncShed()                             {}
@@ -0,0 +1,159 @@
+package tor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// maxBlacklistSize is the maximum size of a downloaded blacklist so a broken
+// or malicious server can not exhaust the memory
+const maxBlacklistSize = 10 << 20
+
+// BlacklistFetcher downloads a blacklist from a remote url. The ETag and
+// Last-Modified headers of the last download are sent with the next request
+// so an unchanged list is not downloaded again.
+type BlacklistFetcher struct {
+	url          string
+	client       *http.Client
+	etag         string
+	lastModified string
+}
+
+func NewBlacklistFetcher(url string, client *http.Client) *BlacklistFetcher {
+	return &BlacklistFetcher{
+		url:    url,
+		client: client,
+	}
+}
+
+// Fetch returns the words of the remote blacklist. The list contains one
+// word per line or comma separated words, lines starting with # are ignored.
+// If the list did not change since the last download changed is false.
+func (f *BlacklistFetcher) Fetch(ctx context.Context) (words []string, changed bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.url, nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not create blacklist request: %w", err)
+	}
+	if f.etag != "" {
+		req.Header.Set("If-None-Match", f.etag)
+	}
+	if f.lastModified != "" {
+		req.Header.Set("If-Modified-Since", f.lastModified)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not fetch blacklist: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, false, nil
+	case http.StatusOK:
+	default:
+		return nil, false, fmt.Errorf("could not fetch blacklist: invalid status code %d", resp.StatusCode)
+	}
+
+	// read one byte more than allowed to detect oversized lists
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBlacklistSize+1))
+	if err != nil {
+		return nil, false, fmt.Errorf("could not read blacklist: %w", err)
+	}
+	if len(body) > maxBlacklistSize {
+		return nil, false, fmt.Errorf("could not read blacklist: list exceeds %d bytes", maxBlacklistSize)
+	}
+
+	words = ParseList(string(body))
+
+	// only remember the validators after the list was read successfully
+	f.etag = resp.Header.Get("ETag")
+	f.lastModified = resp.Header.Get("Last-Modified")
+	return words, true, nil
+}
+
+// ParseList returns the entries of a list containing one entry per line or
+// comma separated entries. Empty entries and lines starting with # are ignored.
+func ParseList(s string) []string {
+	var entries []string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, entry := range strings.Split(line, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries
+}
+
+// SetBlacklist replaces the remotely managed blacklisted words. The words
+// from the configuration are always kept.
+func (t *Tor) SetBlacklist(words []string) error {
+	blacklist, err := compileBlacklist(slices.Concat(t.configWords, words))
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.blacklistedwords = blacklist
+	return nil
+}
+
+// WatchBlacklist updates the blacklist with the words from f every refresh
+// interval until ctx is canceled. On errors the last good blacklist is kept.
+func (t *Tor) WatchBlacklist(ctx context.Context, f *BlacklistFetcher, refresh time.Duration) {
+	ticker := time.NewTicker(refresh)
+	defer ticker.Stop()
+	for {
+		t.refreshBlacklist(ctx, f)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (t *Tor) refreshBlacklist(ctx context.Context, f *BlacklistFetcher) {
+	words, changed, err := f.Fetch(ctx)
+	if err != nil {
+		t.logger.Error("could not update blacklist, keeping the current one", slog.String("err", err.Error()))
+		return
+	}
+	if !changed {
+		t.logger.Debug("blacklist not modified")
+		return
+	}
+	if err := t.SetBlacklist(words); err != nil {
+		t.logger.Error("could not update blacklist, keeping the current one", slog.String("err", err.Error()))
+		return
+	}
+	t.logger.Info("updated blacklist", slog.Int("words", len(words)))
+}
+
+func compileBlacklist(words []string) (map[string]*regexp.Regexp, error) {
+	blacklist := make(map[string]*regexp.Regexp)
+	for _, word := range words {
+		if word == "" {
+			continue
+		}
+		fullRegex := fmt.Sprintf(`(?i)\b%s\b`, regexp.QuoteMeta(word))
+		re, err := regexp.Compile(fullRegex)
+		if err != nil {
+			return nil, err
+		}
+		blacklist[word] = re
+	}
+	return blacklist, nil
+}
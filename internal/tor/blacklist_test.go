@@ -0,0 +1,132 @@
+package tor
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlacklistFetcher(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	status := http.StatusOK
+	etag := `"v1"`
+	content := "# comment\nfoo\nbar, baz\n\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write([]byte(content))
+	}))
+	defer srv.Close()
+
+	f := NewBlacklistFetcher(srv.URL, srv.Client())
+
+	words, changed, err := f.Fetch(context.Background())
+	require.NoError(t, err)
+	require.True(t, changed)
+	require.Equal(t, []string{"foo", "bar", "baz"}, words)
+
+	words, changed, err = f.Fetch(context.Background())
+	require.NoError(t, err)
+	require.False(t, changed)
+	require.Nil(t, words)
+
+	mu.Lock()
+	etag = `"v2"`
+	content = "qux"
+	mu.Unlock()
+	words, changed, err = f.Fetch(context.Background())
+	require.NoError(t, err)
+	require.True(t, changed)
+	require.Equal(t, []string{"qux"}, words)
+
+	// oversized lists are rejected and the validators are not remembered
+	mu.Lock()
+	etag = `"v3"`
+	content = strings.Repeat("a,", maxBlacklistSize/2+1)
+	mu.Unlock()
+	_, _, err = f.Fetch(context.Background())
+	require.ErrorContains(t, err, "exceeds")
+	require.Equal(t, `"v2"`, f.etag)
+
+	mu.Lock()
+	status = http.StatusInternalServerError
+	mu.Unlock()
+	_, _, err = f.Fetch(context.Background())
+	require.Error(t, err)
+}
+
+func TestRefreshBlacklist(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	status := http.StatusOK
+	content := "remote"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		if r.Header.Get("If-None-Match") == content {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", content)
+		_, _ = w.Write([]byte(content))
+	}))
+	defer srv.Close()
+
+	tor := Tor{
+		logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+		configWords: []string{"local"},
+	}
+	f := NewBlacklistFetcher(srv.URL, srv.Client())
+	words := func() []string {
+		tor.mu.RLock()
+		defer tor.mu.RUnlock()
+		var w []string
+		for word := range tor.blacklistedwords {
+			w = append(w, word)
+		}
+		return w
+	}
+
+	tor.refreshBlacklist(context.Background(), f)
+	require.ElementsMatch(t, []string{"local", "remote"}, words())
+
+	// not modified keeps the current words
+	tor.refreshBlacklist(context.Background(), f)
+	require.ElementsMatch(t, []string{"local", "remote"}, words())
+
+	mu.Lock()
+	content = "changed"
+	mu.Unlock()
+	tor.refreshBlacklist(context.Background(), f)
+	require.ElementsMatch(t, []string{"local", "changed"}, words())
+
+	// errors keep the last good words
+	mu.Lock()
+	status = http.StatusInternalServerError
+	mu.Unlock()
+	tor.refreshBlacklist(context.Background(), f)
+	require.ElementsMatch(t, []string{"local", "changed"}, words())
+}
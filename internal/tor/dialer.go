@@ -0,0 +1,233 @@
+package tor
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// keepAliveProbeCount is the number of unanswered keep-alive probes
+// after which a connection is considered dead
+const keepAliveProbeCount = 3
+
+// isolationTokenLength is the length of the hex encoded isolation tokens
+const isolationTokenLength = 32
+
+type isolationKey struct{}
+
+// NewDialer creates the dialer used to connect to the tor proxy. Keep-alive
+// probes are sent after keepAlive of idle time and then every keepAlive, so
+// a dead connection to the tor proxy is noticed after roughly
+// keepAlive * (keepAliveProbeCount + 1). The probes are answered by the tor
+// proxy and not by the onion, so they can not detect a dead tor circuit.
+// A negative keepAlive disables keep-alive probes.
+func NewDialer(timeout, keepAlive time.Duration) *net.Dialer {
+	d := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: keepAlive,
+	}
+	if keepAlive > 0 {
+		d.KeepAliveConfig = net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     keepAlive,
+			Interval: keepAlive,
+			Count:    keepAliveProbeCount,
+		}
+	}
+	return d
+}
+
+// NewProxyDialContext returns a DialContext function that connects through the
+// SOCKS5 proxy at proxyURL. Hostnames are always passed to the proxy as is
+// (SOCKS5h semantics) so .onion addresses are resolved by tor and never locally.
+// Credentials in the url are used for the SOCKS5 username/password authentication.
+func NewProxyDialContext(proxyURL *url.URL, forward *net.Dialer) (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+	}
+
+	// invalid credentials would only fail on the first request so check them upfront.
+	// The limits are defined in RFC 1929.
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		if len(proxyURL.User.Username()) == 0 || len(proxyURL.User.Username()) > 255 || len(password) > 255 {
+			return nil, fmt.Errorf("invalid proxy credentials: the username must be between 1 and 255 bytes and the password at most 255 bytes long")
+		}
+	}
+
+	d, err := proxy.FromURL(proxyURL, forward)
+	if err != nil {
+		return nil, err
+	}
+	cd, ok := d.(proxy.ContextDialer)
+	if !ok {
+		return nil, fmt.Errorf("proxy dialer does not support contexts")
+	}
+	return cd.DialContext, nil
+}
+
+// CheckProxy connects to the SOCKS5 proxy at addr and checks that it answers
+// the greeting. No connection through the proxy is made.
+func CheckProxy(ctx context.Context, dialer *net.Dialer, addr string) error {
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+
+	// version 5 with the single method no authentication. Proxies requiring
+	// authentication reject the method but still answer with version 5.
+	if _, err := conn.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("no SOCKS5 reply: %w", err)
+	}
+	if reply[0] != 0x05 {
+		return fmt.Errorf("invalid SOCKS version %d in reply", reply[0])
+	}
+	return nil
+}
+
+// NewIsolationToken returns a random token used to isolate the streams of a request
+func NewIsolationToken() (string, error) {
+	b := make([]byte, isolationTokenLength/2)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// WithIsolationToken returns a copy of ctx carrying the isolation token used by
+// the dial functions returned from NewIsolatingProxyDialContext
+func WithIsolationToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, isolationKey{}, token)
+}
+
+// IsolationToken returns the isolation token of ctx or an empty string if it has none
+func IsolationToken(ctx context.Context) string {
+	token, _ := ctx.Value(isolationKey{}).(string)
+	return token
+}
+
+// NewIsolatingProxyDialContext is like NewProxyDialContext but authenticates with
+// the isolation token of the dial context as part of the SOCKS5 username. Tor
+// isolates streams with different credentials by default (IsolateSOCKSAuth) so
+// connections with different tokens use different circuits. Connections without
+// a token use the credentials of proxyURL.
+func NewIsolatingProxyDialContext(proxyURL *url.URL, forward *net.Dialer) (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+	dial, err := NewProxyDialContext(proxyURL, forward)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.User != nil && len(proxyURL.User.Username())+1+isolationTokenLength > 255 {
+		return nil, fmt.Errorf("invalid proxy credentials: the username must be at most %d bytes long to isolate requests", 255-1-isolationTokenLength)
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		token := IsolationToken(ctx)
+		if token == "" {
+			return dial(ctx, network, addr)
+		}
+		d, err := proxy.SOCKS5("tcp", proxyURL.Host, isolationAuth(token, proxyURL.User), forward)
+		if err != nil {
+			return nil, err
+		}
+		cd, ok := d.(proxy.ContextDialer)
+		if !ok {
+			return nil, fmt.Errorf("proxy dialer does not support contexts")
+		}
+		return cd.DialContext(ctx, network, addr)
+	}, nil
+}
+
+// isolationAuth returns the SOCKS5 credentials for token. A configured username
+// is kept as prefix and the password is passed through so authenticating
+// proxies still accept the connection.
+func isolationAuth(token string, user *url.Userinfo) *proxy.Auth {
+	auth := &proxy.Auth{User: token}
+	if user != nil {
+		auth.User = user.Username() + "-" + token
+		auth.Password, _ = user.Password()
+	}
+	return auth
+}
+
+// WithOnionConnectTimeout limits the time to connect to .onion addresses.
+// Connecting includes building the circuit so it usually takes longer than
+// connecting to other hosts. If timeout is not positive dial is returned.
+func WithOnionConnectTimeout(dial func(ctx context.Context, network, addr string) (net.Conn, error), timeout time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if timeout <= 0 {
+		return dial
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		if !strings.HasSuffix(strings.ToLower(host), ".onion") {
+			return dial(ctx, network, addr)
+		}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return dial(ctx, network, addr)
+	}
+}
+
+// socksErrors maps the SOCKS5 reply codes as returned in the dial error to
+// messages shown to the user. The 0xF* codes are the extended onion service
+// errors tor sends if ExtendedErrors is enabled on the SocksPort.
+var socksErrors = []struct {
+	reply   string
+	message string
+}{
+	{"unknown code: 240", "This onion service is offline or does not exist."},
+	{"unknown code: 241", "This onion service has an invalid descriptor and can not be reached."},
+	{"unknown code: 242", "This onion service is offline or does not exist."},
+	{"unknown code: 243", "This onion service is offline or does not exist."},
+	{"unknown code: 244", "This onion service requires client authorization."},
+	{"unknown code: 245", "This onion service requires client authorization."},
+	{"unknown code: 246", "This is not a valid onion address."},
+	{"unknown code: 247", "This onion service did not respond in time."},
+	{"host unreachable", "This onion service is offline or does not exist."},
+	{"TTL expired", "This onion service did not respond in time."},
+	{"general SOCKS server failure", "This onion service is offline or does not exist."},
+	{"connection refused", "This onion service refused the connection."},
+}
+
+// SOCKSErrorMessage returns a user friendly message if err is caused by an
+// error reply of the tor SOCKS proxy. An empty string is returned otherwise.
+func SOCKSErrorMessage(err error) string {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "socks connect" || opErr.Err == nil {
+		return ""
+	}
+	// errors while connecting to the proxy itself are not prefixed
+	reply, ok := strings.CutPrefix(opErr.Err.Error(), "unknown error ")
+	if !ok {
+		return ""
+	}
+	for _, e := range socksErrors {
+		if reply == e.reply {
+			return e.message
+		}
+	}
+	return ""
+}
@@ -0,0 +1,48 @@
+package tor
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prewarm issues a HEAD request to every onion so tor already has a circuit
+// when the first client request arrives. Onions can be given as host names
+// or as full urls. The results are only logged.
+func Prewarm(ctx context.Context, logger *slog.Logger, rt http.RoundTripper, onions []string, timeout time.Duration) {
+	var wg sync.WaitGroup
+	for _, onion := range onions {
+		u := onion
+		if !strings.Contains(u, "://") {
+			u = "http://" + u
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			start := time.Now()
+			req, err := http.NewRequestWithContext(ctx, http.MethodHead, u, nil)
+			if err != nil {
+				logger.Error("could not create prewarm request", slog.String("onion", onion), slog.String("err", err.Error()))
+				return
+			}
+			resp, err := rt.RoundTrip(req)
+			if err != nil {
+				logger.Error("could not prewarm onion", slog.String("onion", onion), slog.Duration("duration", time.Since(start)), slog.String("err", err.Error()))
+				return
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			logger.Info("prewarmed onion", slog.String("onion", onion), slog.Int("status", resp.StatusCode), slog.Duration("duration", time.Since(start)))
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,58 @@
+package tor
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type fakeTransport struct {
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+func (f *fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, req)
+	if strings.HasPrefix(req.URL.Host, "error") {
+		return nil, errors.New("circuit failed")
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
+
+func TestPrewarm(t *testing.T) {
+	t.Parallel()
+
+	onions := []string{
+		"najngkjsdngsdngskjgnskjngdfg.onion",
+		"https://asdf.onion:8443",
+		"error.onion",
+	}
+
+	tr := &fakeTransport{}
+	Prewarm(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil)), tr, onions, time.Minute)
+
+	urls := make([]string, 0, len(tr.requests))
+	for _, req := range tr.requests {
+		require.Equal(t, http.MethodHead, req.Method)
+		urls = append(urls, req.URL.String())
+	}
+	require.ElementsMatch(t, []string{
+		"http://najngkjsdngsdngskjgnskjngdfg.onion",
+		"https://asdf.onion:8443",
+		"http://error.onion",
+	}, urls)
+}
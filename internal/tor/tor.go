@@ -4,44 +4,282 @@ import (
 	"bytes"
 	"compress/gzip"
 	"compress/zlib"
+	"context"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"log/slog"
+	"mime"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/textproto"
+	"net/url"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/firefart/zwiebelproxy/internal/config"
 	"github.com/firefart/zwiebelproxy/internal/helper"
+	"github.com/firefart/zwiebelproxy/internal/tracing"
 
 	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
 )
 
+const (
+	// UpgradeInsecureForward forwards the Upgrade-Insecure-Requests header to the onion
+	UpgradeInsecureForward = "forward"
+	// UpgradeInsecureStrip removes the Upgrade-Insecure-Requests header from all requests
+	UpgradeInsecureStrip = "strip"
+	// UpgradeInsecureStripHTTP removes the Upgrade-Insecure-Requests header from
+	// requests to onions served over plain http
+	UpgradeInsecureStripHTTP = "strip-http"
+)
+
+const (
+	// SecFetchForward forwards the Sec-Fetch-* headers to the onion
+	SecFetchForward = "forward"
+	// SecFetchStrip removes the Sec-Fetch-* headers from all requests
+	SecFetchStrip = "strip"
+	// SecFetchRewrite reports requests between different onions as cross-site
+	SecFetchRewrite = "rewrite"
+)
+
+const (
+	// RefererForward forwards the Referer and Origin headers to the onion
+	RefererForward = "forward"
+	// RefererStrip removes the Referer and Origin headers pointing to the proxy
+	RefererStrip = "strip"
+	// RefererRewrite converts the Referer and Origin headers back to onion addresses
+	RefererRewrite = "rewrite"
+)
+
+const (
+	// ServerHeaderKeep sends the Server header of the onion to the client
+	ServerHeaderKeep = "keep"
+	// ServerHeaderStrip removes the Server header from all responses
+	ServerHeaderStrip = "strip"
+	// ServerHeaderOverride is the prefix of a value replacing the Server header
+	// of all responses like override:nginx
+	ServerHeaderOverride = "override:"
+)
+
+const (
+	// ETagWeaken marks the ETag of modified bodies as weak validator
+	ETagWeaken = "weaken"
+	// ETagRecompute replaces the ETag of modified bodies with a hash of the new body
+	ETagRecompute = "recompute"
+	// ETagStrip removes the ETag of modified bodies
+	ETagStrip = "strip"
+)
+
+// DefaultStripHeaders contains the response headers that are removed by default.
+// They either pin the onion domain (HSTS, HPKP) or reference reporting
+// endpoints that are not reachable through the proxy.
+var DefaultStripHeaders = []string{
+	"Strict-Transport-Security",
+	"Public-Key-Pins",
+	"Public-Key-Pins-Report-Only",
+	"Expect-CT",
+	"Report-To",
+	"NEL",
+}
+
+// DefaultBlacklistContentTypes contains the content types that are scanned for
+// blacklisted words by default.
+var DefaultBlacklistContentTypes = []string{
+	"text/html",
+	"text/plain",
+}
+
+// DefaultProxyErrorMarkers identify error pages generated by http proxies
+// between the proxy and tor like Privoxy
+var DefaultProxyErrorMarkers = []string{
+	"(Privoxy@",
+}
+
+// methodOverrideHeaders are request headers some frameworks use to
+// override the HTTP method of a request
+var methodOverrideHeaders = []string{
+	"X-HTTP-Method-Override",
+	"X-HTTP-Method",
+	"X-Method-Override",
+}
+
+// proxyHeaders are request headers only meant for proxies in front of us.
+// The reverse proxy removes them as hop-by-hop headers, they are also removed
+// here so they never reach the onion.
+var proxyHeaders = []string{
+	"Proxy-Authorization",
+	"Proxy-Connection",
+}
+
+// traceHeaders carry the trace context and baggage of the client. The trace
+// context is not propagated to the onion so they are removed.
+var traceHeaders = []string{
+	"Traceparent",
+	"Tracestate",
+	"Baggage",
+}
+
+// requestBodyContentTypes are the request content types rewritten if the
+// request body rewrite is enabled. Multipart bodies are skipped as they
+// usually contain file uploads.
+var requestBodyContentTypes = []string{
+	"application/x-www-form-urlencoded",
+	"application/json",
+	"text/plain",
+}
+
+// zstdMaxMemory limits the memory used by the zstd decoder so a malicious
+// onion can not announce huge windows
+const zstdMaxMemory = 64 << 20
+
+// httpOnionRegex matches plain http links to onion services
+var httpOnionRegex = regexp.MustCompile(`(?i)http://([a-z0-9.-]+\.onion)\b`)
+
+// onionSuffixRegex matches the .onion top level domain in any case if it is
+// followed by a path, a closing quote, a tag or the end of the body
+var onionSuffixRegex = regexp.MustCompile(`(?i)\.onion([/"<]|$)`)
+
+// cssOnionSuffixRegex additionally matches the .onion top level domain at the
+// end of css urls and imports like url(http://foo.onion) or @import 'foo.onion';
+var cssOnionSuffixRegex = regexp.MustCompile(`(?i)\.onion([/"<)'\s;]|$)`)
+
+// jsonOnionSuffixRegex additionally matches the .onion top level domain in json
+// strings if it is followed by an escaped slash like foo.onion\/path or a port
+var jsonOnionSuffixRegex = regexp.MustCompile(`(?i)\.onion(\\/|:[0-9]+|[/"<]|$)`)
+
+// baseHrefRegex matches base tags which might reference the onion without a
+// path or quotes like <base href=http://foo.onion>
+var baseHrefRegex = regexp.MustCompile(`(?is)<base\b[^>]*>`)
+
+// redirectRegexes match meta refresh tags and common javascript redirects
+var redirectRegexes = []*regexp.Regexp{
+	regexp.MustCompile(`(?is)<meta\b[^>]*\bhttp-equiv\s*=\s*["']?refresh\b[^>]*>`),
+	regexp.MustCompile(`(?i)\blocation(?:\.href)?\s*=\s*(?:"[^"]*"|'[^']*')`),
+	regexp.MustCompile(`(?i)\blocation\.(?:replace|assign)\(\s*(?:"[^"]*"|'[^']*')`),
+}
+
+// onionHostKey is the context key of the onion host a request is sent to
+type onionHostKey struct{}
+
+// BlacklistedError is returned from ModifyResponse if the body contains a blacklisted word
+type BlacklistedError struct {
+	Word string
+}
+
+func (e *BlacklistedError) Error() string {
+	return fmt.Sprintf("access to the site is forbidden because it contains the blacklisted word %q", e.Word)
+}
+
+// ProxyErrorPageError is returned from ModifyResponse if the body is an error page
+// generated by a proxy in front of tor and not by the onion itself
+type ProxyErrorPageError struct {
+	Marker string
+}
+
+func (e *ProxyErrorPageError) Error() string {
+	return fmt.Sprintf("the onion service could not be reached, the proxy returned an error page containing %q", e.Marker)
+}
+
+// collapseSlashesRegex matches multiple slashes directly after the domain
+// and an optional port
+func collapseSlashesRegex(domain string) *regexp.Regexp {
+	return regexp.MustCompile(regexp.QuoteMeta(domain) + `(:[0-9]+)?//+`)
+}
+
+// queryDomainRegex matches the domain in any case if it ends a host name in a
+// plain or url encoded query string, so hosts like domain.evil are not matched
+func queryDomainRegex(domain string) *regexp.Regexp {
+	return regexp.MustCompile(`(?i)` + regexp.QuoteMeta(domain) + `(/|:|\?|&|;|%2F|%3A|%3F|%26|$)`)
+}
+
 type Tor struct {
-	logger           *slog.Logger
-	domain           string
+	logger *slog.Logger
+	domain string
+	// mu protects blacklistedwords which is replaced on blacklist updates
+	mu               sync.RWMutex
 	blacklistedwords map[string]*regexp.Regexp
+	configWords      []string
+	// blacklistTypes are the content types scanned for blacklisted words,
+	// if empty all rewritten content types are scanned
+	blacklistTypes     []string
+	stripHeaders       []string
+	preserveHeaders    []string
+	rewriteReqBody     bool
+	noRewritePlaintext bool
+	keepChunked        bool
+	relativizeSameHost bool
+	stripOverride      bool
+	fixMixedContent    bool
+	rewriteRedirects   bool
+	regenerateDate     bool
+	upgradeInsecure    string
+	secFetch           string
+	referer            string
+	etagPolicy         string
+	serverHeader       string
+	exposeOnionHost    bool
+	proxyErrorMarkers  []string
+	// collapseSlashes matches the slashes after the host, nil if disabled
+	collapseSlashes *regexp.Regexp
+	// queryDomain matches the domain in query strings, nil if disabled
+	queryDomain *regexp.Regexp
+	// recompressLimit limits the number of concurrent recompressions
+	recompressLimit workerLimit
+	// portSchemes maps ports of requests to the scheme used for the onion
+	portSchemes map[string]string
 }
 
-func New(logger *slog.Logger, domain string, blacklistedWords string) (*Tor, error) {
+func New(logger *slog.Logger, cfg config.Config) (*Tor, error) {
 	t := Tor{
-		logger:           logger,
-		domain:           domain,
-		blacklistedwords: make(map[string]*regexp.Regexp),
+		logger:             logger,
+		domain:             strings.ToLower(cfg.Domain),
+		configWords:        strings.Split(cfg.BlacklistedWords, ","),
+		blacklistTypes:     cfg.BlacklistTypes,
+		stripHeaders:       cfg.StripHeaders,
+		preserveHeaders:    cfg.PreserveHeaders,
+		rewriteReqBody:     cfg.RewriteRequestBody,
+		noRewritePlaintext: cfg.NoRewritePlaintext,
+		keepChunked:        cfg.KeepChunked,
+		relativizeSameHost: cfg.RelativizeSameHost,
+		stripOverride:      cfg.StripMethodOverride,
+		fixMixedContent:    cfg.FixMixedContent,
+		rewriteRedirects:   cfg.RewriteRedirects,
+		regenerateDate:     cfg.RegenerateDate,
+		upgradeInsecure:    cfg.UpgradeInsecure,
+		secFetch:           cfg.SecFetch,
+		referer:            cfg.Referer,
+		etagPolicy:         cfg.ETagPolicy,
+		serverHeader:       cfg.ServerHeader,
+		exposeOnionHost:    cfg.ExposeOnionHost,
+		proxyErrorMarkers:  cfg.ProxyErrorMarkers,
+		portSchemes:        cfg.PortSchemes,
+		recompressLimit:    newWorkerLimit(cfg.RecompressWorkers),
 	}
 
-	for _, word := range strings.Split(blacklistedWords, ",") {
-		if word == "" {
-			continue
-		}
-		fullRegex := fmt.Sprintf(`(?i)\b%s\b`, regexp.QuoteMeta(word))
-		re, err := regexp.Compile(fullRegex)
-		if err != nil {
-			return nil, err
-		}
-		t.blacklistedwords[word] = re
+	domain := t.domain
+	if !strings.HasPrefix(domain, ".") {
+		domain = fmt.Sprintf(".%s", domain)
+	}
+	if cfg.CollapseSlashes {
+		t.collapseSlashes = collapseSlashesRegex(domain)
+	}
+	if cfg.RewriteQuery {
+		t.queryDomain = queryDomainRegex(domain)
+	}
+
+	blacklist, err := compileBlacklist(t.configWords)
+	if err != nil {
+		return nil, err
 	}
+	t.blacklistedwords = blacklist
 
 	return &t, nil
 }
@@ -52,13 +290,19 @@ func (t *Tor) Rewrite(r *httputil.ProxyRequest) {
 		domain = fmt.Sprintf(".%s", domain)
 	}
 
-	host, port, err := net.SplitHostPort(r.In.Host)
+	// line breaks in the host would allow injecting headers into the request to the onion
+	inHost := helper.SanitizeString(r.In.Host)
+	host, port, err := net.SplitHostPort(inHost)
 	if err != nil {
 		// no port present
-		host = r.In.Host
+		host = inHost
 		port = r.In.URL.Port()
 	}
 
+	// strip the trailing dot of fully qualified host names
+	host = strings.TrimSuffix(host, ".")
+	// onion addresses are base32 which is case insensitive but tor expects lowercase
+	host = strings.ToLower(host)
 	host = strings.TrimSuffix(host, domain)
 	host = strings.TrimSuffix(host, ".")
 	host = fmt.Sprintf("%s.onion", host)
@@ -71,6 +315,9 @@ func (t *Tor) Rewrite(r *httputil.ProxyRequest) {
 		h := r.In.Header.Get("X-Forwarded-Proto")
 		if h != "" {
 			scheme = h
+		} else if s, ok := t.portSchemes[port]; ok {
+			// onions on nonstandard ports
+			scheme = s
 		} else {
 			switch port {
 			case "":
@@ -91,10 +338,295 @@ func (t *Tor) Rewrite(r *httputil.ProxyRequest) {
 	r.Out.Host = host
 	r.Out.URL.Scheme = scheme
 	r.Out.URL.Host = host
+	r.Out = r.Out.WithContext(context.WithValue(r.Out.Context(), onionHostKey{}, host))
+
+	for _, h := range proxyHeaders {
+		r.Out.Header.Del(h)
+	}
+	for _, h := range traceHeaders {
+		r.Out.Header.Del(h)
+	}
+
+	// onions served over http can not satisfy the https upgrade requested by the
+	// browser, they might redirect to https in a loop
+	switch t.upgradeInsecure {
+	case UpgradeInsecureStrip:
+		r.Out.Header.Del("Upgrade-Insecure-Requests")
+	case UpgradeInsecureStripHTTP:
+		if scheme == "http" {
+			r.Out.Header.Del("Upgrade-Insecure-Requests")
+		}
+	}
+
+	// all onions are subdomains of our domain so the browser reports requests
+	// between different onions as same-site while they are cross-site
+	switch t.secFetch {
+	case SecFetchStrip:
+		for h := range r.Out.Header {
+			if strings.HasPrefix(h, "Sec-Fetch-") {
+				r.Out.Header.Del(h)
+			}
+		}
+	case SecFetchRewrite:
+		if strings.EqualFold(r.Out.Header.Get("Sec-Fetch-Site"), "same-site") {
+			initiator := r.In.Header.Get("Origin")
+			if initiator == "" {
+				initiator = r.In.Header.Get("Referer")
+			}
+			var name string
+			if u, err := url.Parse(initiator); err == nil {
+				name = onionName(u.Host, domain)
+			}
+			if name == "" || name != onionName(r.In.Host, domain) {
+				r.Out.Header.Set("Sec-Fetch-Site", "cross-site")
+			}
+		}
+	}
+
+	// the browser sends our domain as referer which tells the onion which
+	// gateway was used and breaks referer checks of the onion
+	for _, h := range []string{"Referer", "Origin"} {
+		v := r.Out.Header.Get(h)
+		if v == "" {
+			continue
+		}
+		switch t.referer {
+		case RefererStrip:
+			if _, ok := rewriteReferer(v, domain); ok {
+				r.Out.Header.Del(h)
+			}
+		case RefererRewrite:
+			rewritten, ok := rewriteReferer(v, domain)
+			if !ok {
+				continue
+			}
+			if rewritten == "" {
+				r.Out.Header.Del(h)
+			} else {
+				r.Out.Header.Set(h, rewritten)
+			}
+		}
+	}
+
+	// prevent the onion from handling the request with a different method
+	if t.stripOverride {
+		for _, h := range methodOverrideHeaders {
+			r.Out.Header.Del(h)
+		}
+	}
+
+	// convert links to our domain in the query string back to the onion address
+	// so redirect parameters and the like point to the real onion service
+	if t.queryDomain != nil && r.Out.URL.RawQuery != "" {
+		r.Out.URL.RawQuery = t.queryDomain.ReplaceAllString(r.Out.URL.RawQuery, ".onion$1")
+	}
+
+	// form submissions might contain absolute urls to our domain in hidden fields
+	if t.rewriteReqBody && r.Out.Body != nil && r.Out.Body != http.NoBody {
+		mediaType, _, _ := mime.ParseMediaType(r.Out.Header.Get("Content-Type"))
+		if helper.SliceContains(requestBodyContentTypes, strings.ToLower(mediaType)) {
+			t.rewriteRequestBody(r.Out, domain)
+		}
+	}
+
+	// the server already rejects line breaks in headers but the values might
+	// have been modified above so never send them to the onion
+	for k, v := range r.Out.Header {
+		if strings.ContainsAny(k, "\r\n") {
+			t.logger.Warn("removed request header containing a line break", slog.String("header", helper.SanitizeString(k)))
+			delete(r.Out.Header, k)
+			continue
+		}
+		for i := range v {
+			if strings.ContainsAny(v[i], "\r\n") {
+				t.logger.Warn("removed line break from request header", slog.String("header", k))
+				v[i] = helper.SanitizeString(v[i])
+			}
+		}
+	}
 
 	t.logger.Debug("modified request", slog.String("request", fmt.Sprintf("%+v", r.Out)))
 }
 
+// workerLimit limits the number of concurrent workers, nil means no limit
+type workerLimit chan struct{}
+
+func newWorkerLimit(workers int) workerLimit {
+	if workers <= 0 {
+		return nil
+	}
+	return make(workerLimit, workers)
+}
+
+// acquire blocks until a worker is available or ctx is done
+func (l workerLimit) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	select {
+	case l <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l workerLimit) release() {
+	if l != nil {
+		<-l
+	}
+}
+
+// decodeGzip decodes all gzip members in raw. Some servers append garbage
+// after the gzip stream, in this case the data decoded until then is returned
+// together with the number of ignored bytes.
+func decodeGzip(raw []byte) ([]byte, int, error) {
+	r := bytes.NewReader(raw)
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	var out bytes.Buffer
+	for {
+		// stop at the end of the member so the following data can be checked
+		zr.Multistream(false)
+		if _, err := io.Copy(&out, zr); err != nil {
+			return nil, 0, err
+		}
+		remaining := r.Len()
+		if remaining == 0 {
+			return out.Bytes(), 0, nil
+		}
+		if err := zr.Reset(r); err != nil {
+			// not another gzip member
+			return out.Bytes(), remaining, nil
+		}
+	}
+}
+
+// rewriteRequestBody replaces the domain with .onion in the body of r. The
+// body needs to be buffered for this so the Content-Length can be updated.
+func (t *Tor) rewriteRequestBody(r *http.Request, domain string) {
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		// errors like an exceeded body limit are returned when the body is sent
+		t.logger.Debug("could not read request body", slog.String("err", err.Error()))
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), &errReader{err: err}))
+		return
+	}
+
+	body = bytes.ReplaceAll(body, []byte(domain), []byte(".onion"))
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	r.ContentLength = int64(len(body))
+	r.TransferEncoding = nil
+	r.Header.Set("Content-Length", fmt.Sprint(len(body)))
+}
+
+// errReader returns err on every read
+type errReader struct {
+	err error
+}
+
+func (e *errReader) Read([]byte) (int, error) {
+	return 0, e.err
+}
+
+// onionV3Length is the length of the base32 encoded v3 onion address
+// consisting of the public key, a checksum and the version
+const onionV3Length = 56
+
+// ValidOnionAddress reports whether name, without the .onion suffix, is a
+// syntactically valid v3 onion address. Tor refuses to connect to everything
+// else which would waste a circuit and the timeout.
+func ValidOnionAddress(name string) bool {
+	if len(name) != onionV3Length {
+		return false
+	}
+	for _, c := range strings.ToLower(name) {
+		if (c < 'a' || c > 'z') && (c < '2' || c > '7') {
+			return false
+		}
+	}
+	return true
+}
+
+// NormalizeOnion returns the onion address without the .onion suffix in
+// lowercase for hosts like www.abcd.onion:8080. Subdomains and ports are
+// removed as they belong to the same onion service.
+func NormalizeOnion(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSpace(host))
+	host = strings.TrimSuffix(host, ".")
+	host = strings.TrimSuffix(host, ".onion")
+	return host[strings.LastIndex(host, ".")+1:]
+}
+
+// onionName returns the label of host directly below the domain which
+// identifies the onion service, e.g. abcd for www.abcd.<domain>. An empty
+// string is returned if host is not below the domain.
+func onionName(host, domain string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	name, ok := strings.CutSuffix(host, strings.ToLower(domain))
+	if !ok || name == "" {
+		return ""
+	}
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+// rewriteReferer converts a url to a subdomain of domain back to the onion
+// address with the same port handling as the request host. The second return
+// value is false if the url does not point to the proxy. Urls of the proxy
+// itself, like the landing page, have no onion so an empty string is returned.
+func rewriteReferer(value, domain string) (string, bool) {
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		return value, false
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == strings.ToLower(strings.TrimPrefix(domain, ".")) {
+		return "", true
+	}
+	name, ok := strings.CutSuffix(host, strings.ToLower(domain))
+	if !ok || name == "" {
+		return value, false
+	}
+	host = fmt.Sprintf("%s.onion", name)
+	if port := u.Port(); port != "" && port != "80" && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	u.Host = host
+	return u.String(), true
+}
+
+// RewriteHeader returns a copy of header with all onion addresses
+// replaced by the domain
+func (t *Tor) RewriteHeader(header http.Header) http.Header {
+	domain := t.domain
+	if !strings.HasPrefix(domain, ".") {
+		domain = fmt.Sprintf(".%s", domain)
+	}
+
+	// the replacement might change the casing of header names so keep them canonical
+	rewritten := make(http.Header, len(header))
+	for k, v := range header {
+		k = textproto.CanonicalMIMEHeaderKey(replaceOnion(k, domain))
+		for _, v2 := range v {
+			v2 = replaceOnion(v2, domain)
+			rewritten[k] = append(rewritten[k], v2)
+		}
+	}
+	return rewritten
+}
+
 // modify the response
 func (t *Tor) ModifyResponse(resp *http.Response) error {
 	t.logger.Debug("entered modifyResponse",
@@ -103,26 +635,78 @@ func (t *Tor) ModifyResponse(resp *http.Response) error {
 		slog.String("headers", fmt.Sprintf("%#v", resp.Header)),
 	)
 
+	_, span := tracing.Tracer().Start(resp.Request.Context(), "rewrite response")
+	defer span.End()
+
 	domain := t.domain
 	if !strings.HasPrefix(domain, ".") {
 		domain = fmt.Sprintf(".%s", domain)
 	}
 
-	for k, v := range resp.Header {
-		k = strings.ReplaceAll(k, ".onion", domain)
-		resp.Header[k] = []string{}
-		for _, v2 := range v {
-			v2 = strings.ReplaceAll(v2, ".onion", domain)
-			resp.Header[k] = append(resp.Header[k], v2)
+	// cookies are rewritten attribute wise so the cookie values stay untouched
+	// and the browser accepts the domain
+	cookies := resp.Header.Values("Set-Cookie")
+	// redirect targets are parsed so only the host is rewritten
+	location := resp.Header.Get("Location")
+	// headers like signed tokens must not be altered
+	preserved := make(http.Header, len(t.preserveHeaders))
+	for _, h := range t.preserveHeaders {
+		if v := resp.Header.Values(h); len(v) > 0 {
+			preserved[textproto.CanonicalMIMEHeaderKey(h)] = v
+		}
+	}
+	resp.Header = t.RewriteHeader(resp.Header)
+	for h, v := range preserved {
+		resp.Header[h] = v
+	}
+	if len(cookies) > 0 {
+		stripSecure := !strings.EqualFold(resp.Request.URL.Scheme, "https")
+		resp.Header.Del("Set-Cookie")
+		for _, c := range cookies {
+			resp.Header.Add("Set-Cookie", rewriteSetCookie(c, domain, stripSecure))
 		}
 	}
+	if location != "" {
+		resp.Header.Set("Location", rewriteLocation(location, domain))
+	}
+
+	// upstream might send the same Content-Length multiple times, the http client
+	// already rejects differing values so keep only one of them
+	if cl := resp.Header.Values("Content-Length"); len(cl) > 1 {
+		resp.Header.Set("Content-Length", cl[0])
+	}
 
 	// remove headers like HSTS
-	headersToRemove := []string{"Strict-Transport-Security", "Public-Key-Pins", "Public-Key-Pins-Report-Only"}
-	for _, h := range headersToRemove {
+	for _, h := range t.stripHeaders {
 		resp.Header.Del(h)
 	}
 
+	// the server header might reveal the software the onion is running
+	switch {
+	case t.serverHeader == ServerHeaderStrip:
+		resp.Header.Del("Server")
+	case strings.HasPrefix(t.serverHeader, ServerHeaderOverride):
+		resp.Header.Set("Server", strings.TrimPrefix(t.serverHeader, ServerHeaderOverride))
+	}
+
+	// set after rewriting the headers so the onion is not replaced
+	if t.exposeOnionHost {
+		if host, ok := resp.Request.Context().Value(onionHostKey{}).(string); ok {
+			resp.Header.Set("X-Onion-Host", host)
+		}
+	}
+
+	// the clock of the onion might be skewed
+	if t.regenerateDate {
+		resp.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+
+	// nothing to rewrite in empty bodies
+	if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified || resp.Header.Get("Content-Length") == "0" {
+		t.logger.Debug("detected empty body, not attempting to modify body", slog.String("url", helper.SanitizeString(resp.Request.URL.String())))
+		return nil
+	}
+
 	// no body modification on file downloads
 	// https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Content-Disposition
 	contentDisp, ok := resp.Header["Content-Disposition"]
@@ -131,6 +715,13 @@ func (t *Tor) ModifyResponse(resp *http.Response) error {
 		return nil
 	}
 
+	// partial responses can not be rewritten as the length of the rewritten
+	// body would not match the requested range anymore
+	if resp.StatusCode == http.StatusPartialContent || resp.Header.Get("Content-Range") != "" {
+		t.logger.Debug("detected partial content, not attempting to modify body", slog.String("url", helper.SanitizeString(resp.Request.URL.String())))
+		return nil
+	}
+
 	// https://developer.mozilla.org/en-US/docs/Web/HTTP/Basics_of_HTTP/MIME_types/Common_types
 	contentTypesForReplace := []string{
 		"text/plain",
@@ -154,62 +745,194 @@ func (t *Tor) ModifyResponse(resp *http.Response) error {
 		return nil
 	}
 
+	var cleanedUpContentType string
 	if ok && len(contentType) > 0 {
 		// https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Content-Type
-		cleanedUpContentType := strings.Split(contentType[0], ";")[0]
+		cleanedUpContentType = strings.Split(contentType[0], ";")[0]
+		// plain text files might discuss onion addresses so the rewrite can be disabled
+		if t.noRewritePlaintext && strings.EqualFold(cleanedUpContentType, "text/plain") {
+			t.logger.Debug("did not replace because plain text rewriting is disabled", slog.String("url", helper.SanitizeString(resp.Request.URL.String())))
+			return nil
+		}
 		if !helper.SliceContains(contentTypesForReplace, cleanedUpContentType) {
 			t.logger.Debug("did not replace because of content type", slog.String("url", helper.SanitizeString(resp.Request.URL.String())), slog.String("content-type", cleanedUpContentType))
 			return nil
 		}
 	}
 
+	// read the whole body first so we can fall back to it if the decoding fails
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error on reading body: %w", err)
+	}
+
 	var reader io.Reader
 	usedGzip := false
 	usedZlib := false
 	usedBrotli := false
+	usedZstd := false
 	contentEncoding := resp.Header.Get("Content-Encoding")
 	// https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Content-Encoding
 	switch {
 	case strings.EqualFold(contentEncoding, "gzip"):
 		t.logger.Debug("detected gzipped body", slog.String("url", helper.SanitizeString(resp.Request.URL.String())))
-		var err error
-		reader, err = gzip.NewReader(resp.Body)
-		if err != nil {
-			return fmt.Errorf("could not create gzip reader: %w", err)
+		var decoded []byte
+		var trailing int
+		decoded, trailing, err = decodeGzip(raw)
+		if trailing > 0 {
+			t.logger.Debug("ignoring trailing data after gzip stream", slog.String("url", helper.SanitizeString(resp.Request.URL.String())), slog.Int("bytes", trailing))
 		}
-		// resp.Header.Del("Content-Encoding")
+		reader = bytes.NewReader(decoded)
 		usedGzip = true
 	case strings.EqualFold(contentEncoding, "deflate"):
 		t.logger.Debug("detected zlib body", slog.String("url", helper.SanitizeString(resp.Request.URL.String())))
-		var err error
-		reader, err = zlib.NewReader(resp.Body)
-		if err != nil {
-			return fmt.Errorf("could not create zlib reader: %w", err)
-		}
+		reader, err = zlib.NewReader(bytes.NewReader(raw))
 		usedZlib = true
 	case strings.EqualFold(contentEncoding, "br"):
 		t.logger.Debug("detected brotli body", slog.String("url", helper.SanitizeString(resp.Request.URL.String())))
-		reader = brotli.NewReader(resp.Body)
+		reader = brotli.NewReader(bytes.NewReader(raw))
 		usedBrotli = true
+	case strings.EqualFold(contentEncoding, "zstd"):
+		t.logger.Debug("detected zstd body", slog.String("url", helper.SanitizeString(resp.Request.URL.String())))
+		var zr *zstd.Decoder
+		// the body is decoded at once so there is no need for concurrent decoding
+		zr, err = zstd.NewReader(bytes.NewReader(raw), zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(zstdMaxMemory))
+		if err == nil {
+			defer zr.Close()
+			reader = zr
+		}
+		usedZstd = true
 	default:
-		reader = resp.Body
+		reader = bytes.NewReader(raw)
 	}
 
 	// for all other content replace .onion urls with our custom domain
-	body, err := io.ReadAll(reader)
+	var body []byte
+	if err == nil {
+		body, err = io.ReadAll(reader)
+	}
 	if err != nil {
-		return fmt.Errorf("error on reading body: %w", err)
+		// proxies in between might already have decoded the body but left the
+		// Content-Encoding header in place. In this case use the body as is.
+		t.logger.Debug("could not decode body, treating it as already decoded", slog.String("url", helper.SanitizeString(resp.Request.URL.String())), slog.String("content-encoding", contentEncoding), slog.String("err", err.Error()))
+		body = raw
+		usedGzip = false
+		usedZlib = false
+		usedBrotli = false
+		usedZstd = false
+		resp.Header.Del("Content-Encoding")
+	}
+
+	// do not continue processing if the request deadline is already exceeded
+	if err := resp.Request.Context().Err(); err != nil {
+		return fmt.Errorf("request aborted: %w", err)
+	}
+
+	// rewrite the body as UTF-8 so non ASCII compatible charsets like UTF-16 are handled
+	var charset encoding.Encoding
+	if len(contentType) > 0 {
+		if _, params, err := mime.ParseMediaType(contentType[0]); err == nil && params["charset"] != "" {
+			enc, err := htmlindex.Get(params["charset"])
+			switch {
+			case err != nil:
+				t.logger.Debug("unknown charset, rewriting raw bytes", slog.String("url", helper.SanitizeString(resp.Request.URL.String())), slog.String("charset", params["charset"]))
+			case enc != unicode.UTF8:
+				decoded, err := enc.NewDecoder().Bytes(body)
+				if err != nil {
+					t.logger.Debug("could not decode charset, rewriting raw bytes", slog.String("url", helper.SanitizeString(resp.Request.URL.String())), slog.String("charset", params["charset"]), slog.String("err", err.Error()))
+				} else {
+					body = decoded
+					charset = enc
+				}
+			}
+		}
+	}
+
+	// links to the currently proxied onion do not need the host at all
+	if t.relativizeSameHost && resp.Request.URL.Host != "" {
+		for _, prefix := range []string{"https://", "http://", "//"} {
+			body = bytes.ReplaceAll(body, []byte(fmt.Sprintf("%s%s/", prefix, resp.Request.URL.Host)), []byte("/"))
+		}
+	}
+
+	// browsers block http resources on https pages so upgrade the links.
+	// The scheme of the proxied request matches the scheme of the client request.
+	if t.fixMixedContent && strings.EqualFold(resp.Request.URL.Scheme, "https") {
+		body = httpOnionRegex.ReplaceAll(body, []byte("https://$1"))
 	}
 
 	// replace stuff for domain replacement
-	body = bytes.ReplaceAll(body, []byte(".onion/"), []byte(fmt.Sprintf("%s/", domain)))
-	body = bytes.ReplaceAll(body, []byte(`.onion"`), []byte(fmt.Sprintf(`%s"`, domain)))
-	body = bytes.ReplaceAll(body, []byte(".onion<"), []byte(fmt.Sprintf("%s<", domain)))
+	suffixRegex := onionSuffixRegex
+	switch strings.ToLower(cleanedUpContentType) {
+	case "text/css":
+		suffixRegex = cssOnionSuffixRegex
+	case "application/json", "application/ld+json":
+		suffixRegex = jsonOnionSuffixRegex
+	}
+	body = suffixRegex.ReplaceAll(body, []byte(fmt.Sprintf("%s${1}", domain)))
+	// a missed base tag would resolve all relative links against the onion
+	body = baseHrefRegex.ReplaceAllFunc(body, func(b []byte) []byte {
+		return []byte(replaceOnion(string(b), domain))
+	})
+
+	// redirects might reference the onion in ways the replacements above
+	// do not catch, like quoted urls in meta refresh tags or with a port
+	if t.rewriteRedirects {
+		for _, re := range redirectRegexes {
+			body = re.ReplaceAllFunc(body, func(b []byte) []byte {
+				return []byte(replaceOnion(string(b), domain))
+			})
+		}
+	}
+
+	// onions sometimes link to //path which results in domain//path. Only the
+	// slashes directly after the host are collapsed so the scheme is untouched.
+	if t.collapseSlashes != nil {
+		body = t.collapseSlashes.ReplaceAll(body, []byte(domain+"$1/"))
+	}
 
-	for word, re := range t.blacklistedwords {
-		if re.Match(body) {
-			return fmt.Errorf("access to the site is forbidden because it contains the blacklisted word %q", word)
+	// do not show error pages of proxies like Privoxy as if they were sent by the onion
+	if strings.EqualFold(cleanedUpContentType, "text/html") {
+		for _, marker := range t.proxyErrorMarkers {
+			if bytes.Contains(body, []byte(marker)) {
+				return &ProxyErrorPageError{Marker: marker}
+			}
+		}
+	}
+
+	// scanning big bodies is expensive so only scan the configured content types
+	if len(t.blacklistTypes) == 0 || helper.SliceContains(t.blacklistTypes, strings.ToLower(cleanedUpContentType)) {
+		t.mu.RLock()
+		blacklist := t.blacklistedwords
+		t.mu.RUnlock()
+		for word, re := range blacklist {
+			if re.Match(body) {
+				return &BlacklistedError{Word: word}
+			}
+		}
+	}
+
+	// convert the body back to the original charset. If the domain can not be
+	// represented in the charset the body is sent as UTF-8 instead
+	if charset != nil {
+		encoded, err := charset.NewEncoder().Bytes(body)
+		if err != nil {
+			t.logger.Debug("could not encode charset, sending UTF-8", slog.String("url", helper.SanitizeString(resp.Request.URL.String())), slog.String("err", err.Error()))
+			mediaType, params, _ := mime.ParseMediaType(contentType[0])
+			params["charset"] = "utf-8"
+			resp.Header.Set("Content-Type", mime.FormatMediaType(mediaType, params))
+		} else {
+			body = encoded
+		}
+	}
+
+	// compressing is CPU bound so the number of concurrent recompressions is
+	// limited independent of the number of requests
+	if usedGzip || usedZlib || usedBrotli || usedZstd {
+		if err := t.recompressLimit.acquire(resp.Request.Context()); err != nil {
+			return fmt.Errorf("request aborted: %w", err)
 		}
+		defer t.recompressLimit.release()
 	}
 
 	// if we unpacked before, respect the client and repack the modified body (the header is still set)
@@ -234,12 +957,129 @@ func (t *Tor) ModifyResponse(resp *http.Response) error {
 			return fmt.Errorf("could not brotli body: %w", err)
 		}
 		body = b
+	} else if usedZstd {
+		t.logger.Debug("re zstding body", slog.String("url", helper.SanitizeString(resp.Request.URL.String())))
+		z, err := helper.ZstdInput(body)
+		if err != nil {
+			return fmt.Errorf("could not zstd body: %w", err)
+		}
+		body = z
+	}
+
+	// byte offsets of range requests would not match the modified body
+	if !bytes.Equal(body, raw) {
+		resp.Header.Del("Accept-Ranges")
+		t.modifyETag(resp.Header, body)
 	}
 
 	// body can be read only once so recreate a new reader
 	resp.Body = io.NopCloser(bytes.NewBuffer(body))
 
+	// keep the framing of chunked upstream responses so clients
+	// like HTTP/1.0 ones still get the body they can handle
+	if t.keepChunked && helper.SliceContains(resp.TransferEncoding, "chunked") {
+		t.logger.Debug("keeping chunked transfer encoding", slog.String("url", helper.SanitizeString(resp.Request.URL.String())))
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+		return nil
+	}
+
+	// trailers are only sent on chunked responses so do not set a Content-Length.
+	// They were read together with the body and are copied by the reverse proxy.
+	if len(resp.Trailer) > 0 {
+		t.logger.Debug("keeping trailers", slog.String("url", helper.SanitizeString(resp.Request.URL.String())))
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+		return nil
+	}
+
 	// update the content-length to our new body
-	resp.Header["Content-Length"] = []string{fmt.Sprint(len(body))}
+	resp.Header.Set("Content-Length", fmt.Sprint(len(body)))
 	return nil
 }
+
+// modifyETag applies the etag policy to the ETag header of a response whose
+// body was modified, as the upstream ETag no longer matches the delivered content
+func (t *Tor) modifyETag(header http.Header, body []byte) {
+	etag := header.Get("ETag")
+	if etag == "" {
+		return
+	}
+
+	switch t.etagPolicy {
+	case ETagWeaken:
+		if !strings.HasPrefix(etag, "W/") {
+			header.Set("ETag", "W/"+etag)
+		}
+	case ETagRecompute:
+		header.Set("ETag", fmt.Sprintf(`"%x"`, sha256.Sum256(body)))
+	case ETagStrip:
+		header.Del("ETag")
+	}
+}
+
+// rewriteSetCookie rewrites the Domain attribute of a Set-Cookie header value
+// from the onion to the domain. If stripSecure is set the Secure flag is removed
+// so the cookie is also sent over plain http. All other attributes are kept.
+func rewriteSetCookie(cookie, domain string, stripSecure bool) string {
+	parts := strings.Split(cookie, ";")
+	kept := parts[:1]
+	for _, part := range parts[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch {
+		case strings.EqualFold(name, "Domain"):
+			// a leading dot is ignored by browsers
+			value = strings.TrimPrefix(strings.TrimSpace(value), ".")
+			if len(value) > len(".onion") && strings.EqualFold(value[len(value)-len(".onion"):], ".onion") {
+				part = fmt.Sprintf(" %s=%s%s", name, value[:len(value)-len(".onion")], domain)
+			}
+		case strings.EqualFold(name, "Secure") && stripSecure:
+			continue
+		}
+		kept = append(kept, part)
+	}
+	return strings.Join(kept, ";")
+}
+
+// rewriteLocation rewrites the onion host of a redirect target to the domain.
+// Like in Rewrite the ports 80 and 443 are not part of the host on our domain,
+// all other ports are kept so the request is sent to the same port of the
+// onion. Path, query and fragment are not modified.
+func rewriteLocation(location, domain string) string {
+	u, err := url.Parse(location)
+	if err != nil {
+		return replaceOnion(location, domain)
+	}
+	host := u.Hostname()
+	if !strings.HasSuffix(strings.ToLower(host), ".onion") {
+		// relative redirects and redirects to other hosts
+		return location
+	}
+	host = host[:len(host)-len(".onion")] + domain
+	if port := u.Port(); port != "" && port != "80" && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	u.Host = host
+	return u.String()
+}
+
+// replaceOnion replaces all .onion occurrences with the domain. Hosts that
+// already end in the domain are left untouched so the replacement is
+// idempotent even if the domain itself starts with .onion
+func replaceOnion(s, domain string) string {
+	var b strings.Builder
+	for {
+		i := strings.Index(s, ".onion")
+		if i < 0 {
+			b.WriteString(s)
+			return b.String()
+		}
+		b.WriteString(s[:i])
+		b.WriteString(domain)
+		if strings.HasPrefix(s[i:], domain) {
+			s = s[i+len(domain):]
+		} else {
+			s = s[i+len(".onion"):]
+		}
+	}
+}
@@ -2,15 +2,29 @@ package tor
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/http/httputil"
+	"net/textproto"
 	"net/url"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/firefart/zwiebelproxy/internal/config"
+	"github.com/firefart/zwiebelproxy/internal/helper"
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
 )
 
 func TestRewrite(t *testing.T) {
@@ -27,6 +41,8 @@ func TestRewrite(t *testing.T) {
 		{fmt.Sprintf("https://asdf.%s/1234", domain), "", "https", "asdf.onion"},
 		{fmt.Sprintf("http://asdf.%s:8008/1234", domain), "8008", "http", "asdf.onion:8008"},
 		{fmt.Sprintf("https://asdf.%s:8008/1234", domain), "8008", "https", "asdf.onion:8008"},
+		{fmt.Sprintf("http://asdf.%s./1234", domain), "", "http", "asdf.onion"},
+		{fmt.Sprintf("https://asdf.%s.:8008/1234", domain), "8008", "https", "asdf.onion:8008"},
 	}
 	for _, tt := range tests {
 		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
@@ -56,6 +72,135 @@ func TestRewrite(t *testing.T) {
 	}
 }
 
+func TestRewriteLineBreaks(t *testing.T) {
+	t.Parallel()
+
+	const domain = "onion.zwiebel"
+	tests := []struct {
+		name         string
+		host         string
+		expectedHost string
+	}{
+		{"trailing line break", "asdf.onion.zwiebel\r\n", "asdf.onion"},
+		{"injected header", "asdf.onion.zwiebel\r\nX-Injected: 1", ""},
+		{"injected header with port", "asdf.onion.zwiebel:8080\nX-Injected: 1", ""},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			r, err := http.NewRequest(http.MethodGet, "http://asdf.onion.zwiebel/", nil)
+			require.NoError(t, err)
+			r.Host = tt.host
+			// set directly as the header functions do not validate the values
+			r.Header["X-Test"] = []string{"a\r\nX-Injected: 1"}
+			r.Header["X-Bad\r\nKey"] = []string{"b"}
+			tor := Tor{
+				domain: domain,
+				logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+			}
+			pr := &httputil.ProxyRequest{
+				In:  r,
+				Out: r.Clone(r.Context()),
+			}
+			tor.Rewrite(pr)
+			if tt.expectedHost != "" {
+				assert.Equal(t, tt.expectedHost, pr.Out.Host)
+			}
+			assert.NotContains(t, pr.Out.Host, "\n")
+			assert.NotContains(t, pr.Out.Host, "\r")
+			assert.NotContains(t, pr.Out.URL.Host, "\n")
+			assert.NotContains(t, pr.Out.URL.Host, "\r")
+			assert.Equal(t, []string{"aX-Injected: 1"}, pr.Out.Header["X-Test"])
+			assert.NotContains(t, pr.Out.Header, "X-Bad\r\nKey")
+			assert.Empty(t, pr.Out.Header.Values("X-Injected"))
+		})
+	}
+}
+
+func TestRewritePortSchemes(t *testing.T) {
+	t.Parallel()
+
+	const domain = "onion.zwiebel"
+	tests := []struct {
+		host           string
+		expectedScheme string
+	}{
+		{fmt.Sprintf("asdf.%s:8443", domain), "https"},
+		{fmt.Sprintf("asdf.%s:8080", domain), "http"},
+		{fmt.Sprintf("asdf.%s:8008", domain), "http"},
+		{fmt.Sprintf("asdf.%s:443", domain), "https"},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.host, func(t *testing.T) {
+			t.Parallel()
+
+			r, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/", tt.host), nil)
+			require.NoError(t, err)
+			// server requests do not contain a scheme
+			r.URL.Scheme = ""
+			tor := Tor{
+				domain:      domain,
+				logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+				portSchemes: map[string]string{"8443": "https", "8080": "http"},
+			}
+			pr := &httputil.ProxyRequest{
+				In:  r,
+				Out: r.Clone(r.Context()),
+			}
+			tor.Rewrite(pr)
+			assert.Equal(t, tt.expectedScheme, pr.Out.URL.Scheme)
+		})
+	}
+}
+
+func TestExposeOnionHost(t *testing.T) {
+	t.Parallel()
+
+	const domain = "onion.zwiebel"
+	tests := []struct {
+		name     string
+		host     string
+		expose   bool
+		expected string
+	}{
+		{"enabled", fmt.Sprintf("asdf.%s", domain), true, "asdf.onion"},
+		{"enabled with port", fmt.Sprintf("asdf.%s:8008", domain), true, "asdf.onion:8008"},
+		{"disabled", fmt.Sprintf("asdf.%s", domain), false, ""},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			r, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/", tt.host), nil)
+			require.NoError(t, err)
+			tor := Tor{
+				domain:          domain,
+				logger:          slog.New(slog.NewTextHandler(io.Discard, nil)),
+				exposeOnionHost: tt.expose,
+			}
+			pr := &httputil.ProxyRequest{
+				In:  r,
+				Out: r.Clone(r.Context()),
+			}
+			tor.Rewrite(pr)
+
+			resp := http.Response{
+				StatusCode: 200,
+				Request:    pr.Out,
+				Header:     make(http.Header),
+				Body:       io.NopCloser(bytes.NewBufferString("test")),
+			}
+			resp.Header.Set("Content-Type", "text/plain")
+			require.NoError(t, tor.ModifyResponse(&resp))
+			assert.Equal(t, tt.expected, resp.Header.Get("X-Onion-Host"))
+		})
+	}
+}
+
 func TestRewriteWebRequest(t *testing.T) {
 	t.Parallel()
 
@@ -73,6 +218,8 @@ func TestRewriteWebRequest(t *testing.T) {
 		{"/1234", fmt.Sprintf("asdf.%s:8008", domain), "8008", "http", "asdf.onion:8008"},
 		{"/1234", fmt.Sprintf("asdf.%s:80", domain), "", "http", "asdf.onion"},
 		{"/1234", fmt.Sprintf("asdf.%s:443", domain), "", "https", "asdf.onion"},
+		{"/1234", fmt.Sprintf("ASDF.%s", domain), "", "http", "asdf.onion"},
+		{"/1234", "AsDf.ONION.Zwiebel:8008", "8008", "http", "asdf.onion:8008"},
 	}
 	for _, tt := range tests {
 		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
@@ -110,21 +257,107 @@ func TestRewriteWebRequest(t *testing.T) {
 	}
 }
 
+func TestRewriteQuery(t *testing.T) {
+	t.Parallel()
+
+	const domain = "onion.zwiebel"
+	tests := []struct {
+		name          string
+		rewriteQuery  bool
+		url           string
+		expectedQuery string
+	}{
+		{"disabled", false, fmt.Sprintf("http://asdf.%s/redirect?next=http://qwer.%s/test", domain, domain), fmt.Sprintf("next=http://qwer.%s/test", domain)},
+		{"enabled", true, fmt.Sprintf("http://asdf.%s/redirect?next=http://qwer.%s/test", domain, domain), "next=http://qwer.onion/test"},
+		{"enabled encoded", true, fmt.Sprintf("http://asdf.%s/redirect?a=1&next=http%%3A%%2F%%2Fqwer.%s%%2Ftest", domain, domain), "a=1&next=http%3A%2F%2Fqwer.onion%2Ftest"},
+		{"enabled no onion", true, fmt.Sprintf("http://asdf.%s/redirect?next=http://example.com/test", domain), "next=http://example.com/test"},
+		{"enabled end of query", true, fmt.Sprintf("http://asdf.%s/redirect?host=qwer.%s", domain, domain), "host=qwer.onion"},
+		{"enabled port", true, fmt.Sprintf("http://asdf.%s/redirect?next=http://qwer.%s:8080/test", domain, domain), "next=http://qwer.onion:8080/test"},
+		{"enabled mixed case", true, fmt.Sprintf("http://asdf.%s/redirect?next=http://QWER.ONION.Zwiebel/test&a=1", domain), "next=http://QWER.onion/test&a=1"},
+		{"enabled mixed case encoded", true, fmt.Sprintf("http://asdf.%s/redirect?next=http%%3a%%2f%%2fqwer.Onion.Zwiebel%%2ftest", domain), "next=http%3a%2f%2fqwer.onion%2ftest"},
+		{"enabled lookalike domain", true, fmt.Sprintf("http://asdf.%s/redirect?next=http://qwer.%sxyz/test", domain, domain), fmt.Sprintf("next=http://qwer.%sxyz/test", domain)},
+		{"enabled lookalike subdomain", true, fmt.Sprintf("http://asdf.%s/redirect?next=http://qwer.%s.evil/test", domain, domain), fmt.Sprintf("next=http://qwer.%s.evil/test", domain)},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			r, err := http.NewRequest(http.MethodGet, tt.url, nil)
+			require.NoError(t, err)
+			tor := Tor{
+				domain: domain,
+				logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+			}
+			if tt.rewriteQuery {
+				tor.queryDomain = queryDomainRegex("." + domain)
+			}
+			pr := &httputil.ProxyRequest{
+				In:  r,
+				Out: r.Clone(r.Context()),
+			}
+			tor.Rewrite(pr)
+			assert.Equal(t, "asdf.onion", pr.Out.URL.Host)
+			assert.Equal(t, tt.expectedQuery, pr.Out.URL.RawQuery)
+		})
+	}
+}
+
 func TestModifyResponse(t *testing.T) {
 	t.Parallel()
 
 	const domain = "xxx.zwiebel"
 	body := []byte("asfasdf najngkjsdngsdngskjgnskjngdfg.onion safdsdfa akjfajfklf.onion/asdfasf")
+	css := []byte(`@import 'http://abcd.onion';
+@import url(http://efgh.onion);
+@import http://ijkl.onion;
+body { background: url(http://mnop.onion) no-repeat; }
+.x { background: url("http://qrst.onion/a.png"); }`)
+	cssExpected := []string{
+		"@import 'http://abcd.xxx.zwiebel';",
+		"@import url(http://efgh.xxx.zwiebel);",
+		"@import http://ijkl.xxx.zwiebel;",
+		"url(http://mnop.xxx.zwiebel) no-repeat",
+		`url("http://qrst.xxx.zwiebel/a.png")`,
+	}
+	json := []byte(`{"host":"abcd.onion","url":"efgh.onion:8080","escaped":"http:\/\/ijkl.onion\/path","port":"http:\/\/mnop.onion:8443\/x","link":"http://qrst.onion/a"}`)
+	jsonExpected := []string{
+		`"host":"abcd.xxx.zwiebel"`,
+		`"url":"efgh.xxx.zwiebel:8080"`,
+		`"escaped":"http:\/\/ijkl.xxx.zwiebel\/path"`,
+		`"port":"http:\/\/mnop.xxx.zwiebel:8443\/x"`,
+		`"link":"http://qrst.xxx.zwiebel/a"`,
+	}
+	base := []byte(`<base href="http://abcd.onion"><base href='http://efgh.onion'><base href=http://ijkl.onion>`)
+	baseExpected := []string{
+		`<base href="http://abcd.xxx.zwiebel">`,
+		`<base href='http://efgh.xxx.zwiebel'>`,
+		`<base href=http://ijkl.xxx.zwiebel>`,
+	}
 	tests := []struct {
-		name        string
-		download    bool
-		contentType string
-		body        []byte
+		name            string
+		download        bool
+		contentType     string
+		contentEncoding string
+		body            []byte
+		expected        []string
 	}{
-		{"empty", false, "", body},
-		{"download", true, "text/plain", body},
-		{"plain", false, "text/plain", body},
-		{"octet-stream", false, "application/octet-stream", body},
+		{"empty", false, "", "", body, nil},
+		{"download", true, "text/plain", "", body, nil},
+		{"plain", false, "text/plain", "", body, nil},
+		{"octet-stream", false, "application/octet-stream", "", body, nil},
+		{"zstd", false, "text/plain", "zstd", body, []string{"akjfajfklf.xxx.zwiebel/asdfasf"}},
+		{"css", false, "text/css", "", css, cssExpected},
+		{"css charset", false, "text/css; charset=utf-8", "", css, cssExpected},
+		{"css already rewritten", false, "text/css", "", []byte("url(http://abcd.xxx.zwiebel)"), []string{"url(http://abcd.xxx.zwiebel)"}},
+		{"css download", true, "text/css", "", css, []string{"@import 'http://abcd.onion';", "url(http://mnop.onion)"}},
+		{"json", false, "application/json", "", json, jsonExpected},
+		{"json ld", false, "application/ld+json; charset=utf-8", "", json, jsonExpected},
+		{"json already rewritten", false, "application/json", "", []byte(`{"url":"efgh.xxx.zwiebel:8080"}`), []string{`{"url":"efgh.xxx.zwiebel:8080"}`}},
+		{"base href without trailing slash", false, "text/html", "", base, baseExpected},
+		{"ends with onion", false, "text/html", "", []byte("visit http://abcd.onion"), []string{"visit http://abcd.xxx.zwiebel"}},
+		{"css ends with onion", false, "text/css", "", []byte("@import http://abcd.onion"), []string{"@import http://abcd.xxx.zwiebel"}},
+		{"json ends with onion", false, "application/json", "", []byte(`"http:\/\/abcd.onion`), []string{`"http:\/\/abcd.xxx.zwiebel`}},
 	}
 	for _, tt := range tests {
 		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
@@ -147,7 +380,14 @@ func TestModifyResponse(t *testing.T) {
 				resp.Header["Content-Type"] = []string{tt.contentType}
 			}
 
-			resp.Body = io.NopCloser(bytes.NewBuffer(tt.body))
+			b := tt.body
+			if tt.contentEncoding == "zstd" {
+				var err error
+				b, err = helper.ZstdInput(tt.body)
+				require.NoError(t, err)
+				resp.Header.Set("Content-Encoding", tt.contentEncoding)
+			}
+			resp.Body = io.NopCloser(bytes.NewBuffer(b))
 
 			tor := Tor{
 				domain: domain,
@@ -165,7 +405,1526 @@ func TestModifyResponse(t *testing.T) {
 				return
 			}
 
+			if tt.contentEncoding == "zstd" {
+				zr, err := zstd.NewReader(nil)
+				require.NoError(t, err)
+				defer zr.Close()
+				modifiedBody, err = zr.DecodeAll(modifiedBody, nil)
+				require.NoError(t, err)
+			}
+
+			for _, e := range tt.expected {
+				assert.Contains(t, string(modifiedBody), e)
+			}
+
 			assert.NotContains(t, modifiedBody, domain)
 		})
 	}
 }
+
+func TestModifyResponseCaseInsensitive(t *testing.T) {
+	t.Parallel()
+
+	const domain = ".xxx.zwiebel"
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{"lowercase", `<a href="http://Foo.onion/x">Foo.onion</a>`, `<a href="http://Foo.xxx.zwiebel/x">Foo.xxx.zwiebel</a>`},
+		{"uppercase", `<a href="http://FOO.ONION/x">FOO.ONION</a>`, `<a href="http://FOO.xxx.zwiebel/x">FOO.xxx.zwiebel</a>`},
+		{"mixed case", `<a href="http://foo.Onion">foo.OnIoN</a>`, `<a href="http://foo.xxx.zwiebel">foo.xxx.zwiebel</a>`},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			resp := http.Response{
+				StatusCode: 200,
+				Request: &http.Request{
+					URL: &url.URL{},
+				},
+				Header: make(http.Header),
+				Body:   io.NopCloser(bytes.NewBufferString(tt.body)),
+			}
+			resp.Header.Set("Content-Type", "text/html")
+
+			tor := Tor{
+				domain: domain,
+				logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+			}
+			require.NoError(t, tor.ModifyResponse(&resp))
+			modifiedBody, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, string(modifiedBody))
+		})
+	}
+}
+
+func TestModifyResponseStripHeaders(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name         string
+		stripHeaders []string
+		header       string
+		removed      bool
+	}{
+		{"hsts", DefaultStripHeaders, "Strict-Transport-Security", true},
+		{"expect-ct", DefaultStripHeaders, "Expect-CT", true},
+		{"report-to", DefaultStripHeaders, "Report-To", true},
+		{"nel", DefaultStripHeaders, "NEL", true},
+		{"not configured", []string{"Strict-Transport-Security"}, "Report-To", false},
+		{"custom", []string{"X-Custom"}, "X-Custom", true},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			resp := http.Response{
+				StatusCode: 200,
+				Request: &http.Request{
+					URL: &url.URL{},
+				},
+				Header: make(http.Header),
+				Body:   io.NopCloser(bytes.NewBuffer(nil)),
+			}
+			resp.Header.Set(tt.header, `{"group":"default","endpoints":[{"url":"https://asdf.onion/report"}]}`)
+
+			tor, err := New(slog.New(slog.NewTextHandler(io.Discard, nil)), config.Config{
+				Domain:       "xxx.zwiebel",
+				StripHeaders: tt.stripHeaders,
+			})
+			require.NoError(t, err)
+			require.NoError(t, tor.ModifyResponse(&resp))
+			if tt.removed {
+				assert.Empty(t, resp.Header.Get(tt.header))
+			} else {
+				assert.NotEmpty(t, resp.Header.Get(tt.header))
+			}
+		})
+	}
+}
+
+func TestModifyResponseSetCookie(t *testing.T) {
+	t.Parallel()
+
+	const domain = "xxx.zwiebel"
+	cookies := []string{
+		"session=x; Domain=abcd.onion; Path=/; Secure; HttpOnly",
+		"pref=http://abcd.onion/; domain=.ABCD.ONION; SameSite=Lax",
+		"other=y; Max-Age=3600; Secure",
+	}
+	tests := []struct {
+		name     string
+		scheme   string
+		expected []string
+	}{
+		{"http", "http", []string{
+			"session=x; Domain=abcd.xxx.zwiebel; Path=/; HttpOnly",
+			"pref=http://abcd.onion/; domain=ABCD.xxx.zwiebel; SameSite=Lax",
+			"other=y; Max-Age=3600",
+		}},
+		{"https", "https", []string{
+			"session=x; Domain=abcd.xxx.zwiebel; Path=/; Secure; HttpOnly",
+			"pref=http://abcd.onion/; domain=ABCD.xxx.zwiebel; SameSite=Lax",
+			"other=y; Max-Age=3600; Secure",
+		}},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			resp := http.Response{
+				StatusCode: 200,
+				Request: &http.Request{
+					URL: &url.URL{Scheme: tt.scheme, Host: "abcd.onion"},
+				},
+				Header: make(http.Header),
+				Body:   io.NopCloser(bytes.NewBuffer(nil)),
+			}
+			for _, c := range cookies {
+				resp.Header.Add("Set-Cookie", c)
+			}
+
+			tor := Tor{
+				domain: domain,
+				logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+			}
+			require.NoError(t, tor.ModifyResponse(&resp))
+			assert.Equal(t, tt.expected, resp.Header.Values("Set-Cookie"))
+		})
+	}
+}
+
+func TestModifyResponseRegenerateDate(t *testing.T) {
+	t.Parallel()
+
+	const upstreamDate = "Mon, 02 Jan 2006 15:04:05 GMT"
+	tests := []struct {
+		name           string
+		regenerateDate bool
+	}{
+		{"enabled", true},
+		{"disabled", false},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			resp := http.Response{
+				StatusCode: 200,
+				Request: &http.Request{
+					URL: &url.URL{},
+				},
+				Header: make(http.Header),
+				Body:   io.NopCloser(bytes.NewBuffer(nil)),
+			}
+			resp.Header.Set("Date", upstreamDate)
+
+			tor, err := New(slog.New(slog.NewTextHandler(io.Discard, nil)), config.Config{
+				Domain:         "xxx.zwiebel",
+				RegenerateDate: tt.regenerateDate,
+			})
+			require.NoError(t, err)
+			start := time.Now().Truncate(time.Second)
+			require.NoError(t, tor.ModifyResponse(&resp))
+			if !tt.regenerateDate {
+				require.Equal(t, upstreamDate, resp.Header.Get("Date"))
+				return
+			}
+			date, err := http.ParseTime(resp.Header.Get("Date"))
+			require.NoError(t, err)
+			require.False(t, date.Before(start))
+		})
+	}
+}
+
+func TestModifyResponseServerHeader(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name         string
+		serverHeader string
+		upstream     string
+		expected     []string
+	}{
+		{"keep", ServerHeaderKeep, "Apache/2.4.41 (Ubuntu)", []string{"Apache/2.4.41 (Ubuntu)"}},
+		{"default", "", "Apache/2.4.41 (Ubuntu)", []string{"Apache/2.4.41 (Ubuntu)"}},
+		{"strip", ServerHeaderStrip, "Apache/2.4.41 (Ubuntu)", nil},
+		{"override", ServerHeaderOverride + "nginx", "Apache/2.4.41 (Ubuntu)", []string{"nginx"}},
+		{"override missing header", ServerHeaderOverride + "nginx", "", []string{"nginx"}},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			resp := http.Response{
+				StatusCode: 200,
+				Request: &http.Request{
+					URL: &url.URL{},
+				},
+				Header: make(http.Header),
+				Body:   io.NopCloser(bytes.NewBuffer(nil)),
+			}
+			if tt.upstream != "" {
+				resp.Header.Set("Server", tt.upstream)
+			}
+
+			tor, err := New(slog.New(slog.NewTextHandler(io.Discard, nil)), config.Config{
+				Domain:       "xxx.zwiebel",
+				ServerHeader: tt.serverHeader,
+			})
+			require.NoError(t, err)
+			require.NoError(t, tor.ModifyResponse(&resp))
+			require.Equal(t, tt.expected, resp.Header.Values("Server"))
+		})
+	}
+}
+
+func TestModifyResponseCanonicalHeaders(t *testing.T) {
+	t.Parallel()
+
+	resp := http.Response{
+		StatusCode: 200,
+		Request: &http.Request{
+			URL: &url.URL{},
+		},
+		Header: http.Header{
+			"x-lowercase":             []string{"a"},
+			"X-From-foo.onion":        []string{"http://foo.onion/"},
+			"content-security-policy": []string{"default-src http://foo.onion"},
+			"X-Already-Canonical":     []string{"b"},
+			"x-already-canonical":     []string{"c"},
+		},
+		Body: io.NopCloser(bytes.NewBuffer(nil)),
+	}
+
+	tor := Tor{
+		domain: ".xxx.zwiebel",
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	require.NoError(t, tor.ModifyResponse(&resp))
+	for k := range resp.Header {
+		require.Equal(t, textproto.CanonicalMIMEHeaderKey(k), k)
+	}
+	require.Equal(t, []string{"a"}, resp.Header["X-Lowercase"])
+	require.Equal(t, []string{"http://foo.xxx.zwiebel/"}, resp.Header["X-From-Foo.xxx.zwiebel"])
+	require.Equal(t, []string{"default-src http://foo.xxx.zwiebel"}, resp.Header["Content-Security-Policy"])
+	require.ElementsMatch(t, []string{"b", "c"}, resp.Header["X-Already-Canonical"])
+}
+
+func TestModifyResponseEncodingMismatch(t *testing.T) {
+	t.Parallel()
+
+	const domain = "xxx.zwiebel"
+	body := []byte(`<a href="http://najngkjsdngsdngskjgnskjngdfg.onion/test">link</a>`)
+	gzipped, err := helper.GzipInput(body)
+	require.NoError(t, err)
+	trailingGarbage := append(append([]byte{}, gzipped...), []byte("\x00\x01garbage")...)
+	first, err := helper.GzipInput(body[:20])
+	require.NoError(t, err)
+	second, err := helper.GzipInput(body[20:])
+	require.NoError(t, err)
+	multipleMembers := append(append([]byte{}, first...), second...)
+
+	tests := []struct {
+		name             string
+		encoding         string
+		body             []byte
+		expectedEncoding string
+	}{
+		{"gzip header with plain body", "gzip", body, ""},
+		{"deflate header with plain body", "deflate", body, ""},
+		{"gzip header with gzip body", "gzip", gzipped, "gzip"},
+		{"gzip body with trailing garbage", "gzip", trailingGarbage, "gzip"},
+		{"gzip body with multiple members", "gzip", multipleMembers, "gzip"},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			resp := http.Response{
+				StatusCode: 200,
+				Request: &http.Request{
+					URL: &url.URL{},
+				},
+				Header: make(http.Header),
+				Body:   io.NopCloser(bytes.NewBuffer(tt.body)),
+			}
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Header.Set("Content-Encoding", tt.encoding)
+
+			tor := Tor{
+				domain: domain,
+				logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+			}
+			require.NoError(t, tor.ModifyResponse(&resp))
+			require.Equal(t, tt.expectedEncoding, resp.Header.Get("Content-Encoding"))
+
+			var reader io.Reader = resp.Body
+			if tt.expectedEncoding == "gzip" {
+				gz, err := gzip.NewReader(resp.Body)
+				require.NoError(t, err)
+				reader = gz
+			}
+			modifiedBody, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			require.Contains(t, string(modifiedBody), "najngkjsdngsdngskjgnskjngdfg.xxx.zwiebel/test")
+		})
+	}
+}
+
+func TestWorkerLimit(t *testing.T) {
+	t.Parallel()
+
+	const workers = 2
+	l := newWorkerLimit(workers)
+	var current, maxSeen atomic.Int32
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, l.acquire(context.Background()))
+			defer l.release()
+			n := current.Add(1)
+			for {
+				m := maxSeen.Load()
+				if n <= m || maxSeen.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			current.Add(-1)
+		}()
+	}
+	wg.Wait()
+	require.LessOrEqual(t, maxSeen.Load(), int32(workers))
+	require.Positive(t, maxSeen.Load())
+
+	// no limit
+	require.Nil(t, newWorkerLimit(0))
+	require.NoError(t, newWorkerLimit(0).acquire(context.Background()))
+}
+
+func TestModifyResponseRecompressLimit(t *testing.T) {
+	t.Parallel()
+
+	body := []byte(`<a href="http://najngkjsdngsdngskjgnskjngdfg.onion/test">link</a>`)
+	gzipped, err := helper.GzipInput(body)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		wantErr  bool
+	}{
+		{"compressed waits for a worker", "gzip", gzipped, true},
+		{"uncompressed needs no worker", "", body, false},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://abcd.onion/", nil)
+			require.NoError(t, err)
+			resp := http.Response{
+				StatusCode: 200,
+				Request:    req,
+				Header:     make(http.Header),
+				Body:       io.NopCloser(bytes.NewBuffer(tt.body)),
+			}
+			resp.Header.Set("Content-Type", "text/html")
+			if tt.encoding != "" {
+				resp.Header.Set("Content-Encoding", tt.encoding)
+			}
+
+			tor := Tor{
+				domain:          "xxx.zwiebel",
+				logger:          slog.New(slog.NewTextHandler(io.Discard, nil)),
+				recompressLimit: newWorkerLimit(1),
+			}
+			// all workers are busy
+			require.NoError(t, tor.recompressLimit.acquire(context.Background()))
+			defer tor.recompressLimit.release()
+
+			err = tor.ModifyResponse(&resp)
+			if tt.wantErr {
+				require.ErrorIs(t, err, context.DeadlineExceeded)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestModifyResponsePlaintext(t *testing.T) {
+	t.Parallel()
+
+	const domain = "xxx.zwiebel"
+	body := []byte(`see http://najngkjsdngsdngskjgnskjngdfg.onion/test for details`)
+	tests := []struct {
+		name               string
+		noRewritePlaintext bool
+		contentType        string
+		rewritten          bool
+	}{
+		{"plain rewritten", false, "text/plain", true},
+		{"plain not rewritten", true, "text/plain; charset=utf-8", false},
+		{"html rewritten", true, "text/html", true},
+		{"json rewritten", true, "application/json", true},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			resp := http.Response{
+				StatusCode: 200,
+				Request: &http.Request{
+					URL: &url.URL{},
+				},
+				Header: make(http.Header),
+				Body:   io.NopCloser(bytes.NewBuffer(body)),
+			}
+			resp.Header.Set("Content-Type", tt.contentType)
+
+			tor := Tor{
+				domain:             domain,
+				logger:             slog.New(slog.NewTextHandler(io.Discard, nil)),
+				noRewritePlaintext: tt.noRewritePlaintext,
+			}
+			require.NoError(t, tor.ModifyResponse(&resp))
+			modifiedBody, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			if tt.rewritten {
+				require.Contains(t, string(modifiedBody), "najngkjsdngsdngskjgnskjngdfg.xxx.zwiebel/test")
+			} else {
+				require.Equal(t, body, modifiedBody)
+			}
+		})
+	}
+}
+
+func TestModifyResponseChunked(t *testing.T) {
+	t.Parallel()
+
+	const domain = "xxx.zwiebel"
+	body := []byte(`<a href="http://najngkjsdngsdngskjgnskjngdfg.onion/test">link</a>`)
+	tests := []struct {
+		name                  string
+		keepChunked           bool
+		transferEncoding      []string
+		expectedContentLength string
+	}{
+		{"chunked kept", true, []string{"chunked"}, ""},
+		{"chunked not kept", false, []string{"chunked"}, "71"},
+		{"not chunked", true, nil, "71"},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			resp := http.Response{
+				StatusCode: 200,
+				Request: &http.Request{
+					URL: &url.URL{},
+				},
+				Header:           make(http.Header),
+				Body:             io.NopCloser(bytes.NewBuffer(body)),
+				ContentLength:    -1,
+				TransferEncoding: tt.transferEncoding,
+			}
+			resp.Header.Set("Content-Type", "text/html")
+
+			tor := Tor{
+				domain:      domain,
+				logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+				keepChunked: tt.keepChunked,
+			}
+			require.NoError(t, tor.ModifyResponse(&resp))
+			require.Equal(t, tt.expectedContentLength, resp.Header.Get("Content-Length"))
+			if tt.expectedContentLength == "" {
+				require.Equal(t, int64(-1), resp.ContentLength)
+				require.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+			}
+			modifiedBody, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Contains(t, string(modifiedBody), "najngkjsdngsdngskjgnskjngdfg.xxx.zwiebel/test")
+		})
+	}
+}
+
+func TestModifyResponseBlacklistTypes(t *testing.T) {
+	t.Parallel()
+
+	const domain = "xxx.zwiebel"
+	body := []byte(`.forbidden { background: url("http://najngkjsdngsdngskjgnskjngdfg.onion/test.png") }`)
+	tests := []struct {
+		name           string
+		blacklistTypes []string
+		contentType    string
+		blocked        bool
+	}{
+		{"css not scanned", DefaultBlacklistContentTypes, "text/css", false},
+		{"css scanned", []string{"text/css"}, "text/css", true},
+		{"all scanned", nil, "text/css", true},
+		{"html scanned", DefaultBlacklistContentTypes, "text/html; charset=utf-8", true},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			resp := http.Response{
+				StatusCode: 200,
+				Request: &http.Request{
+					URL: &url.URL{},
+				},
+				Header: make(http.Header),
+				Body:   io.NopCloser(bytes.NewBuffer(body)),
+			}
+			resp.Header.Set("Content-Type", tt.contentType)
+
+			tor, err := New(slog.New(slog.NewTextHandler(io.Discard, nil)), config.Config{
+				Domain:           domain,
+				BlacklistedWords: "forbidden",
+				BlacklistTypes:   tt.blacklistTypes,
+			})
+			require.NoError(t, err)
+			err = tor.ModifyResponse(&resp)
+			if tt.blocked {
+				var blacklistedError *BlacklistedError
+				require.ErrorAs(t, err, &blacklistedError)
+				return
+			}
+			require.NoError(t, err)
+			modifiedBody, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			// links are rewritten even if the body is not scanned
+			require.Contains(t, string(modifiedBody), "najngkjsdngsdngskjgnskjngdfg.xxx.zwiebel/test.png")
+		})
+	}
+}
+
+func TestModifyResponseRelativizeSameHost(t *testing.T) {
+	t.Parallel()
+
+	const domain = "xxx.zwiebel"
+	body := []byte(`<a href="http://najngkjsdngsdngskjgnskjngdfg.onion/same">same</a>` +
+		`<a href="https://najngkjsdngsdngskjgnskjngdfg.onion/secure">secure</a>` +
+		`<img src="//najngkjsdngsdngskjgnskjngdfg.onion/img.png">` +
+		`<a href="http://najngkjsdngsdngskjgnskjngdfg.onion:8080/port">port</a>` +
+		`<a href="http://other.onion/cross">cross</a>`)
+	tests := []struct {
+		name               string
+		relativizeSameHost bool
+		expected           []string
+	}{
+		{"relativized", true, []string{
+			`href="/same"`,
+			`href="/secure"`,
+			`src="/img.png"`,
+			// a different port is a different host
+			`href="http://najngkjsdngsdngskjgnskjngdfg.onion:8080/port"`,
+			`href="http://other.xxx.zwiebel/cross"`,
+		}},
+		{"absolute", false, []string{
+			`href="http://najngkjsdngsdngskjgnskjngdfg.xxx.zwiebel/same"`,
+			`href="https://najngkjsdngsdngskjgnskjngdfg.xxx.zwiebel/secure"`,
+			`src="//najngkjsdngsdngskjgnskjngdfg.xxx.zwiebel/img.png"`,
+			`href="http://other.xxx.zwiebel/cross"`,
+		}},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			resp := http.Response{
+				StatusCode: 200,
+				Request: &http.Request{
+					URL: &url.URL{Scheme: "http", Host: "najngkjsdngsdngskjgnskjngdfg.onion", Path: "/"},
+				},
+				Header: make(http.Header),
+				Body:   io.NopCloser(bytes.NewBuffer(body)),
+			}
+			resp.Header.Set("Content-Type", "text/html")
+
+			tor := Tor{
+				domain:             domain,
+				logger:             slog.New(slog.NewTextHandler(io.Discard, nil)),
+				relativizeSameHost: tt.relativizeSameHost,
+			}
+			require.NoError(t, tor.ModifyResponse(&resp))
+			modifiedBody, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			for _, e := range tt.expected {
+				require.Contains(t, string(modifiedBody), e)
+			}
+		})
+	}
+}
+
+func TestRewriteStripProxyHeaders(t *testing.T) {
+	t.Parallel()
+
+	const domain = "onion.zwiebel"
+	r, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://asdf.%s/", domain), nil)
+	require.NoError(t, err)
+	r.Header.Set("Proxy-Authorization", "Basic dXNlcjpwYXNz")
+	r.Header.Set("Proxy-Connection", "keep-alive")
+	r.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+	tor := Tor{
+		domain: domain,
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	pr := &httputil.ProxyRequest{
+		In:  r,
+		Out: r.Clone(r.Context()),
+	}
+	tor.Rewrite(pr)
+	assert.Empty(t, pr.Out.Header.Get("Proxy-Authorization"))
+	assert.Empty(t, pr.Out.Header.Get("Proxy-Connection"))
+	// authorization for the onion itself is kept
+	assert.Equal(t, "Basic dXNlcjpwYXNz", pr.Out.Header.Get("Authorization"))
+}
+
+func TestRewriteStripTraceHeaders(t *testing.T) {
+	t.Parallel()
+
+	const domain = "onion.zwiebel"
+	r, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://asdf.%s/", domain), nil)
+	require.NoError(t, err)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r.Header.Set("tracestate", "vendor=value")
+	r.Header.Set("baggage", "user=secret")
+	tor := Tor{
+		domain: domain,
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	pr := &httputil.ProxyRequest{
+		In:  r,
+		Out: r.Clone(r.Context()),
+	}
+	tor.Rewrite(pr)
+	assert.Empty(t, pr.Out.Header.Get("Traceparent"))
+	assert.Empty(t, pr.Out.Header.Get("Tracestate"))
+	assert.Empty(t, pr.Out.Header.Get("Baggage"))
+}
+
+func TestRewriteUpgradeInsecureRequests(t *testing.T) {
+	t.Parallel()
+
+	const domain = "onion.zwiebel"
+	tests := []struct {
+		name     string
+		handling string
+		url      string
+		expected string
+	}{
+		{"forward http", UpgradeInsecureForward, fmt.Sprintf("http://asdf.%s/", domain), "1"},
+		{"strip http", UpgradeInsecureStrip, fmt.Sprintf("http://asdf.%s/", domain), ""},
+		{"strip https", UpgradeInsecureStrip, fmt.Sprintf("https://asdf.%s/", domain), ""},
+		{"strip-http http", UpgradeInsecureStripHTTP, fmt.Sprintf("http://asdf.%s/", domain), ""},
+		{"strip-http https", UpgradeInsecureStripHTTP, fmt.Sprintf("https://asdf.%s/", domain), "1"},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			r, err := http.NewRequest(http.MethodGet, tt.url, nil)
+			require.NoError(t, err)
+			r.Header.Set("Upgrade-Insecure-Requests", "1")
+			tor := Tor{
+				domain:          domain,
+				logger:          slog.New(slog.NewTextHandler(io.Discard, nil)),
+				upgradeInsecure: tt.handling,
+			}
+			pr := &httputil.ProxyRequest{
+				In:  r,
+				Out: r.Clone(r.Context()),
+			}
+			tor.Rewrite(pr)
+			assert.Equal(t, tt.expected, pr.Out.Header.Get("Upgrade-Insecure-Requests"))
+		})
+	}
+}
+
+func TestRewriteSecFetchHeaders(t *testing.T) {
+	t.Parallel()
+
+	const domain = "onion.zwiebel"
+	tests := []struct {
+		name     string
+		handling string
+		referer  string
+		expected http.Header
+	}{
+		{"forward", SecFetchForward, fmt.Sprintf("http://other.%s/", domain), http.Header{
+			"Sec-Fetch-Site": {"same-site"},
+			"Sec-Fetch-Mode": {"navigate"},
+			"Sec-Fetch-Dest": {"document"},
+		}},
+		{"strip", SecFetchStrip, fmt.Sprintf("http://other.%s/", domain), http.Header{}},
+		{"rewrite other onion", SecFetchRewrite, fmt.Sprintf("http://other.%s/", domain), http.Header{
+			"Sec-Fetch-Site": {"cross-site"},
+			"Sec-Fetch-Mode": {"navigate"},
+			"Sec-Fetch-Dest": {"document"},
+		}},
+		{"rewrite same onion", SecFetchRewrite, fmt.Sprintf("http://www.asdf.%s/", domain), http.Header{
+			"Sec-Fetch-Site": {"same-site"},
+			"Sec-Fetch-Mode": {"navigate"},
+			"Sec-Fetch-Dest": {"document"},
+		}},
+		{"rewrite no referer", SecFetchRewrite, "", http.Header{
+			"Sec-Fetch-Site": {"cross-site"},
+			"Sec-Fetch-Mode": {"navigate"},
+			"Sec-Fetch-Dest": {"document"},
+		}},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			r, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://asdf.%s/", domain), nil)
+			require.NoError(t, err)
+			r.Header.Set("Sec-Fetch-Site", "same-site")
+			r.Header.Set("Sec-Fetch-Mode", "navigate")
+			r.Header.Set("Sec-Fetch-Dest", "document")
+			if tt.referer != "" {
+				r.Header.Set("Referer", tt.referer)
+			}
+			tor := Tor{
+				domain:   domain,
+				logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+				secFetch: tt.handling,
+			}
+			pr := &httputil.ProxyRequest{
+				In:  r,
+				Out: r.Clone(r.Context()),
+			}
+			tor.Rewrite(pr)
+			for _, h := range []string{"Sec-Fetch-Site", "Sec-Fetch-Mode", "Sec-Fetch-Dest"} {
+				assert.Equal(t, tt.expected.Values(h), pr.Out.Header.Values(h), h)
+			}
+		})
+	}
+}
+
+func TestRewriteRefererHeaders(t *testing.T) {
+	t.Parallel()
+
+	const domain = "onion.zwiebel"
+	tests := []struct {
+		name            string
+		handling        string
+		referer         string
+		origin          string
+		expectedReferer string
+		expectedOrigin  string
+	}{
+		{"forward", RefererForward, "https://asdf.onion.zwiebel/page", "https://asdf.onion.zwiebel", "https://asdf.onion.zwiebel/page", "https://asdf.onion.zwiebel"},
+		{"rewrite same onion", RefererRewrite, "https://asdf.onion.zwiebel/page?a=b", "https://asdf.onion.zwiebel", "https://asdf.onion/page?a=b", "https://asdf.onion"},
+		{"rewrite other onion", RefererRewrite, "http://other.onion.zwiebel/", "http://other.onion.zwiebel", "http://other.onion/", "http://other.onion"},
+		{"rewrite port", RefererRewrite, "http://other.onion.zwiebel:8080/x", "http://other.onion.zwiebel:443", "http://other.onion:8080/x", "http://other.onion"},
+		{"rewrite uppercase", RefererRewrite, "http://OTHER.ONION.ZWIEBEL/", "", "http://other.onion/", ""},
+		{"rewrite landing page", RefererRewrite, "https://onion.zwiebel/", "https://onion.zwiebel", "", ""},
+		{"rewrite foreign", RefererRewrite, "https://example.com/", "null", "https://example.com/", "null"},
+		{"strip", RefererStrip, "https://asdf.onion.zwiebel/page", "https://other.onion.zwiebel", "", ""},
+		{"strip foreign", RefererStrip, "https://example.com/", "null", "https://example.com/", "null"},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			r, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://asdf.%s/", domain), nil)
+			require.NoError(t, err)
+			r.Header.Set("Referer", tt.referer)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			tor := Tor{
+				domain:  domain,
+				logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+				referer: tt.handling,
+			}
+			pr := &httputil.ProxyRequest{
+				In:  r,
+				Out: r.Clone(r.Context()),
+			}
+			tor.Rewrite(pr)
+			assert.Equal(t, tt.expectedReferer, pr.Out.Header.Get("Referer"))
+			assert.Equal(t, tt.expectedOrigin, pr.Out.Header.Get("Origin"))
+		})
+	}
+}
+
+func TestRewriteRequestBody(t *testing.T) {
+	t.Parallel()
+
+	const domain = "onion.zwiebel"
+	form := url.Values{
+		"redirect": {"http://asdf.onion.zwiebel/account"},
+		"name":     {"test"},
+	}.Encode()
+	tests := []struct {
+		name        string
+		enabled     bool
+		contentType string
+		expected    string
+	}{
+		{"form", true, "application/x-www-form-urlencoded", url.Values{
+			"redirect": {"http://asdf.onion/account"},
+			"name":     {"test"},
+		}.Encode()},
+		{"form with charset", true, "application/x-www-form-urlencoded; charset=UTF-8", url.Values{
+			"redirect": {"http://asdf.onion/account"},
+			"name":     {"test"},
+		}.Encode()},
+		{"disabled", false, "application/x-www-form-urlencoded", form},
+		{"multipart", true, "multipart/form-data; boundary=x", form},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			r, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://asdf.%s/login", domain), bytes.NewBufferString(form))
+			require.NoError(t, err)
+			r.Header.Set("Content-Type", tt.contentType)
+			tor := Tor{
+				domain:         domain,
+				logger:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+				rewriteReqBody: tt.enabled,
+			}
+			pr := &httputil.ProxyRequest{
+				In:  r,
+				Out: r.Clone(r.Context()),
+			}
+			tor.Rewrite(pr)
+
+			body, err := io.ReadAll(pr.Out.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, string(body))
+			assert.Equal(t, int64(len(tt.expected)), pr.Out.ContentLength)
+		})
+	}
+}
+
+func TestRewriteStripMethodOverride(t *testing.T) {
+	t.Parallel()
+
+	const domain = "onion.zwiebel"
+	tests := []struct {
+		name          string
+		stripOverride bool
+	}{
+		{"disabled", false},
+		{"enabled", true},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			r, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://asdf.%s/", domain), nil)
+			require.NoError(t, err)
+			for _, h := range methodOverrideHeaders {
+				r.Header.Set(h, http.MethodDelete)
+			}
+			r.Header.Set("X-Other", "test")
+			tor := Tor{
+				domain:        domain,
+				logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+				stripOverride: tt.stripOverride,
+			}
+			pr := &httputil.ProxyRequest{
+				In:  r,
+				Out: r.Clone(r.Context()),
+			}
+			tor.Rewrite(pr)
+			for _, h := range methodOverrideHeaders {
+				if tt.stripOverride {
+					assert.Empty(t, pr.Out.Header.Get(h))
+				} else {
+					assert.Equal(t, http.MethodDelete, pr.Out.Header.Get(h))
+				}
+			}
+			assert.Equal(t, "test", pr.Out.Header.Get("X-Other"))
+		})
+	}
+}
+
+func TestModifyResponseDuplicateContentLength(t *testing.T) {
+	t.Parallel()
+
+	const domain = "xxx.zwiebel"
+	body := []byte(`<a href="http://najngkjsdngsdngskjgnskjngdfg.onion/test">link</a>`)
+	tests := []struct {
+		name                  string
+		contentType           string
+		expectedContentLength string
+	}{
+		{"rewritten", "text/html", "71"},
+		{"not rewritten", "image/png", fmt.Sprint(len(body))},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			resp := http.Response{
+				StatusCode: 200,
+				Request: &http.Request{
+					URL: &url.URL{},
+				},
+				Header: make(http.Header),
+				Body:   io.NopCloser(bytes.NewBuffer(body)),
+			}
+			resp.Header.Set("Content-Type", tt.contentType)
+			resp.Header.Add("Content-Length", fmt.Sprint(len(body)))
+			resp.Header.Add("Content-Length", fmt.Sprint(len(body)))
+
+			tor := Tor{
+				domain: domain,
+				logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+			}
+			require.NoError(t, tor.ModifyResponse(&resp))
+			require.Equal(t, []string{tt.expectedContentLength}, resp.Header.Values("Content-Length"))
+		})
+	}
+}
+
+func TestModifyResponseEmptyBody(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name          string
+		statusCode    int
+		contentLength string
+	}{
+		{"content length 0", http.StatusOK, "0"},
+		{"no content", http.StatusNoContent, ""},
+		{"not modified", http.StatusNotModified, ""},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			body := io.NopCloser(bytes.NewBuffer(nil))
+			resp := http.Response{
+				StatusCode: tt.statusCode,
+				Request: &http.Request{
+					URL: &url.URL{},
+				},
+				Header: make(http.Header),
+				Body:   body,
+			}
+			resp.Header.Set("Content-Type", "text/html")
+			// decoding the empty body would fail and remove the header
+			resp.Header.Set("Content-Encoding", "gzip")
+			if tt.contentLength != "" {
+				resp.Header.Set("Content-Length", tt.contentLength)
+			}
+
+			tor := Tor{
+				domain: "xxx.zwiebel",
+				logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+			}
+			require.NoError(t, tor.ModifyResponse(&resp))
+			// the body is passed through as is
+			require.Equal(t, body, resp.Body)
+			require.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+			require.Equal(t, tt.contentLength, resp.Header.Get("Content-Length"))
+		})
+	}
+}
+
+func TestModifyResponseAcceptRanges(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{"modified", `<a href="http://najngkjsdngsdngskjgnskjngdfg.onion/test">link</a>`, ""},
+		{"unmodified", `<a href="/test">link</a>`, "bytes"},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			resp := http.Response{
+				StatusCode: 200,
+				Request: &http.Request{
+					URL: &url.URL{},
+				},
+				Header: make(http.Header),
+				Body:   io.NopCloser(bytes.NewBufferString(tt.body)),
+			}
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Header.Set("Content-Length", fmt.Sprint(len(tt.body)))
+			resp.Header.Set("Accept-Ranges", "bytes")
+
+			tor := Tor{
+				domain: "xxx.zwiebel",
+				logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+			}
+			require.NoError(t, tor.ModifyResponse(&resp))
+			require.Equal(t, tt.expected, resp.Header.Get("Accept-Ranges"))
+		})
+	}
+}
+
+func TestModifyResponseETag(t *testing.T) {
+	t.Parallel()
+
+	body := `<a href="http://najngkjsdngsdngskjgnskjngdfg.onion/test">link</a>`
+	modified := `<a href="http://najngkjsdngsdngskjgnskjngdfg.xxx.zwiebel/test">link</a>`
+	tests := []struct {
+		name     string
+		policy   string
+		body     string
+		etag     string
+		expected string
+	}{
+		{"weaken", ETagWeaken, body, `"abc"`, `W/"abc"`},
+		{"weaken weak", ETagWeaken, body, `W/"abc"`, `W/"abc"`},
+		{"recompute", ETagRecompute, body, `"abc"`, fmt.Sprintf(`"%x"`, sha256.Sum256([]byte(modified)))},
+		{"strip", ETagStrip, body, `"abc"`, ""},
+		{"unmodified", ETagStrip, `<a href="/test">link</a>`, `"abc"`, `"abc"`},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			resp := http.Response{
+				StatusCode: 200,
+				Request: &http.Request{
+					URL: &url.URL{},
+				},
+				Header: make(http.Header),
+				Body:   io.NopCloser(bytes.NewBufferString(tt.body)),
+			}
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Header.Set("Content-Length", fmt.Sprint(len(tt.body)))
+			resp.Header.Set("ETag", tt.etag)
+
+			tor := Tor{
+				domain:     "xxx.zwiebel",
+				etagPolicy: tt.policy,
+				logger:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+			}
+			require.NoError(t, tor.ModifyResponse(&resp))
+			require.Equal(t, tt.expected, resp.Header.Get("ETag"))
+		})
+	}
+}
+
+func TestModifyResponseFixMixedContent(t *testing.T) {
+	t.Parallel()
+
+	const domain = "xxx.zwiebel"
+	body := []byte(`<img src="http://najngkjsdngsdngskjgnskjngdfg.onion/img.png">` +
+		`<script src="HTTP://other.onion/app.js"></script>` +
+		`<a href="http://example.com/">clearnet</a>`)
+	tests := []struct {
+		name            string
+		fixMixedContent bool
+		scheme          string
+		expected        []string
+	}{
+		{"https page", true, "https", []string{
+			`src="https://najngkjsdngsdngskjgnskjngdfg.xxx.zwiebel/img.png"`,
+			`src="https://other.xxx.zwiebel/app.js"`,
+			`href="http://example.com/"`,
+		}},
+		{"http page", true, "http", []string{
+			`src="http://najngkjsdngsdngskjgnskjngdfg.xxx.zwiebel/img.png"`,
+			`src="HTTP://other.xxx.zwiebel/app.js"`,
+		}},
+		{"disabled", false, "https", []string{
+			`src="http://najngkjsdngsdngskjgnskjngdfg.xxx.zwiebel/img.png"`,
+			`src="HTTP://other.xxx.zwiebel/app.js"`,
+		}},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			resp := http.Response{
+				StatusCode: 200,
+				Request: &http.Request{
+					URL: &url.URL{Scheme: tt.scheme, Host: "najngkjsdngsdngskjgnskjngdfg.onion", Path: "/"},
+				},
+				Header: make(http.Header),
+				Body:   io.NopCloser(bytes.NewBuffer(body)),
+			}
+			resp.Header.Set("Content-Type", "text/html")
+
+			tor := Tor{
+				domain:          domain,
+				logger:          slog.New(slog.NewTextHandler(io.Discard, nil)),
+				fixMixedContent: tt.fixMixedContent,
+			}
+			require.NoError(t, tor.ModifyResponse(&resp))
+			modifiedBody, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			for _, e := range tt.expected {
+				require.Contains(t, string(modifiedBody), e)
+			}
+		})
+	}
+}
+
+func TestModifyResponseRewriteRedirects(t *testing.T) {
+	t.Parallel()
+
+	body := []byte(`<meta http-equiv="refresh" content="0; url='http://foo.onion'">` +
+		`<META HTTP-EQUIV=Refresh CONTENT="5;URL=http://bar.onion:8080/x">` +
+		`<script>window.location.href = 'http://baz.onion';location.replace("http://qux.onion:8080/y")</script>` +
+		`<p>visit http://text.onion today</p>`)
+	tests := []struct {
+		name             string
+		domain           string
+		rewriteRedirects bool
+		expected         []string
+	}{
+		{"enabled", ".xxx.zwiebel", true, []string{
+			`content="0; url='http://foo.xxx.zwiebel'"`,
+			`CONTENT="5;URL=http://bar.xxx.zwiebel:8080/x"`,
+			`window.location.href = 'http://baz.xxx.zwiebel'`,
+			`location.replace("http://qux.xxx.zwiebel:8080/y")`,
+			`visit http://text.onion`,
+		}},
+		{"domain starting with onion", ".onion.zwiebel", true, []string{
+			`content="0; url='http://foo.onion.zwiebel'"`,
+			`CONTENT="5;URL=http://bar.onion.zwiebel:8080/x"`,
+		}},
+		{"disabled", ".xxx.zwiebel", false, []string{
+			`content="0; url='http://foo.onion'"`,
+			`CONTENT="5;URL=http://bar.onion:8080/x"`,
+			`window.location.href = 'http://baz.onion'`,
+			`location.replace("http://qux.onion:8080/y")`,
+		}},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			resp := http.Response{
+				StatusCode: 200,
+				Request: &http.Request{
+					URL: &url.URL{Scheme: "http", Host: "foo.onion", Path: "/"},
+				},
+				Header: make(http.Header),
+				Body:   io.NopCloser(bytes.NewBuffer(body)),
+			}
+			resp.Header.Set("Content-Type", "text/html")
+
+			tor := Tor{
+				domain:           tt.domain,
+				logger:           slog.New(slog.NewTextHandler(io.Discard, nil)),
+				rewriteRedirects: tt.rewriteRedirects,
+			}
+			require.NoError(t, tor.ModifyResponse(&resp))
+			modifiedBody, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			for _, e := range tt.expected {
+				require.Contains(t, string(modifiedBody), e)
+			}
+			require.NotContains(t, string(modifiedBody), ".zwiebel.zwiebel")
+		})
+	}
+}
+
+func TestModifyResponseCollapseSlashes(t *testing.T) {
+	t.Parallel()
+
+	const domain = ".xxx.zwiebel"
+	body := []byte(`<a href="http://foo.onion//x">` +
+		`<a href="https://bar.onion///y">` +
+		`<a href="http://baz.onion/a//b">`)
+	tests := []struct {
+		name            string
+		collapseSlashes bool
+		expected        []string
+	}{
+		{"enabled", true, []string{
+			`href="http://foo.xxx.zwiebel/x"`,
+			`href="https://bar.xxx.zwiebel/y"`,
+			`href="http://baz.xxx.zwiebel/a//b"`,
+		}},
+		// by default the path is kept as sent by the onion
+		{"disabled", false, []string{
+			`href="http://foo.xxx.zwiebel//x"`,
+			`href="https://bar.xxx.zwiebel///y"`,
+			`href="http://baz.xxx.zwiebel/a//b"`,
+		}},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			resp := http.Response{
+				StatusCode: 200,
+				Request: &http.Request{
+					URL: &url.URL{Scheme: "http", Host: "foo.onion", Path: "/"},
+				},
+				Header: make(http.Header),
+				Body:   io.NopCloser(bytes.NewBuffer(body)),
+			}
+			resp.Header.Set("Content-Type", "text/html")
+
+			tor := Tor{
+				domain: domain,
+				logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+			}
+			if tt.collapseSlashes {
+				tor.collapseSlashes = collapseSlashesRegex(domain)
+			}
+			require.NoError(t, tor.ModifyResponse(&resp))
+			modifiedBody, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			for _, e := range tt.expected {
+				require.Contains(t, string(modifiedBody), e)
+			}
+		})
+	}
+}
+
+func TestModifyResponseLocation(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		location string
+		expected string
+	}{
+		{"http://abcd.onion/path", "http://abcd.xxx.zwiebel/path"},
+		{"https://abcd.onion/path?q=1#top", "https://abcd.xxx.zwiebel/path?q=1#top"},
+		{"https://abcd.onion:8080/path", "https://abcd.xxx.zwiebel:8080/path"},
+		{"https://abcd.onion:443/path", "https://abcd.xxx.zwiebel/path"},
+		{"http://abcd.onion:80/", "http://abcd.xxx.zwiebel/"},
+		{"https://ABCD.ONION/path", "https://ABCD.xxx.zwiebel/path"},
+		{"//abcd.onion/path", "//abcd.xxx.zwiebel/path"},
+		{"http://abcd.xxx.zwiebel/path", "http://abcd.xxx.zwiebel/path"},
+		{"https://abcd.onion/login?next=https%3A%2F%2Fefgh.onion%2F", "https://abcd.xxx.zwiebel/login?next=https%3A%2F%2Fefgh.onion%2F"},
+		{"/relative?x=abcd.onion", "/relative?x=abcd.onion"},
+		{"https://example.com/path", "https://example.com/path"},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.location, func(t *testing.T) {
+			t.Parallel()
+
+			resp := http.Response{
+				StatusCode: http.StatusFound,
+				Request: &http.Request{
+					URL: &url.URL{},
+				},
+				Header: make(http.Header),
+				Body:   io.NopCloser(bytes.NewBufferString("")),
+			}
+			resp.Header.Set("Location", tt.location)
+
+			tor := Tor{
+				domain: "xxx.zwiebel",
+				logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+			}
+			require.NoError(t, tor.ModifyResponse(&resp))
+			assert.Equal(t, tt.expected, resp.Header.Get("Location"))
+		})
+	}
+}
+
+func TestModifyResponsePreserveHeaders(t *testing.T) {
+	t.Parallel()
+
+	resp := http.Response{
+		StatusCode: http.StatusOK,
+		Request: &http.Request{
+			URL: &url.URL{},
+		},
+		Header: make(http.Header),
+		Body:   io.NopCloser(bytes.NewBufferString("")),
+	}
+	resp.Header.Set("X-Signed-Token", "eyJhbGciOi.onion/sig")
+	resp.Header.Add("X-Nonce", "abc.onion/1")
+	resp.Header.Add("X-Nonce", "def.onion/2")
+	resp.Header.Set("X-Other", "abcd.onion/path")
+
+	tor := Tor{
+		domain:          "xxx.zwiebel",
+		logger:          slog.New(slog.NewTextHandler(io.Discard, nil)),
+		preserveHeaders: []string{"x-signed-token", "X-Nonce", "X-Missing"},
+	}
+	require.NoError(t, tor.ModifyResponse(&resp))
+	assert.Equal(t, "eyJhbGciOi.onion/sig", resp.Header.Get("X-Signed-Token"))
+	assert.Equal(t, []string{"abc.onion/1", "def.onion/2"}, resp.Header.Values("X-Nonce"))
+	assert.Equal(t, "abcd.xxx.zwiebel/path", resp.Header.Get("X-Other"))
+	assert.Empty(t, resp.Header.Values("X-Missing"))
+}
+
+func TestModifyResponseAuthChallenge(t *testing.T) {
+	t.Parallel()
+
+	body := "authentication required"
+	resp := http.Response{
+		StatusCode: http.StatusUnauthorized,
+		Request: &http.Request{
+			URL: &url.URL{},
+		},
+		Header: make(http.Header),
+		Body:   io.NopCloser(bytes.NewBufferString(body)),
+	}
+	resp.Header.Set("Content-Type", "text/plain")
+	resp.Header.Set("Content-Length", fmt.Sprint(len(body)))
+	resp.Header.Add("WWW-Authenticate", `Basic realm="abcd.onion", charset="UTF-8"`)
+	resp.Header.Add("WWW-Authenticate", `Digest realm="Login to http://abcd.onion/admin", nonce="abc"`)
+
+	tor := Tor{
+		domain: "xxx.zwiebel",
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	require.NoError(t, tor.ModifyResponse(&resp))
+	// the challenge is passed through so the browser prompts for credentials
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	require.Equal(t, []string{
+		`Basic realm="abcd.xxx.zwiebel", charset="UTF-8"`,
+		`Digest realm="Login to http://abcd.xxx.zwiebel/admin", nonce="abc"`,
+	}, resp.Header.Values("WWW-Authenticate"))
+	modifiedBody, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, body, string(modifiedBody))
+}
+
+func TestModifyResponseIdempotent(t *testing.T) {
+	t.Parallel()
+
+	// the proxy domain starts with .onion so a naive replace rewrites it again
+	const domain = "onion.zwiebel"
+	body := []byte(`<a href="http://proxied.onion.zwiebel/test">proxied</a>` +
+		`<a href="http://raw.onion/test">raw</a>` +
+		`<span>proxied.onion.zwiebel</span>`)
+
+	resp := http.Response{
+		StatusCode: 200,
+		Request: &http.Request{
+			URL: &url.URL{},
+		},
+		Header: make(http.Header),
+		Body:   io.NopCloser(bytes.NewBuffer(body)),
+	}
+	resp.Header.Set("Content-Type", "text/html")
+	resp.Header.Set("Location", "http://proxied.onion.zwiebel/")
+	resp.Header.Set("Link", "<http://raw.onion/style.css>; rel=preload")
+
+	tor := Tor{
+		domain: domain,
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	require.NoError(t, tor.ModifyResponse(&resp))
+	require.Equal(t, "http://proxied.onion.zwiebel/", resp.Header.Get("Location"))
+	require.Equal(t, "<http://raw.onion.zwiebel/style.css>; rel=preload", resp.Header.Get("Link"))
+	modifiedBody, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, `<a href="http://proxied.onion.zwiebel/test">proxied</a>`+
+		`<a href="http://raw.onion.zwiebel/test">raw</a>`+
+		`<span>proxied.onion.zwiebel</span>`, string(modifiedBody))
+}
+
+func TestReplaceOnion(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		in       string
+		domain   string
+		expected string
+	}{
+		{"http://a.onion/", ".xxx.zwiebel", "http://a.xxx.zwiebel/"},
+		{"http://a.onion/", ".onion.zwiebel", "http://a.onion.zwiebel/"},
+		{"http://a.onion.zwiebel/", ".onion.zwiebel", "http://a.onion.zwiebel/"},
+		{"a.onion b.onion.zwiebel c.onion", ".onion.zwiebel", "a.onion.zwiebel b.onion.zwiebel c.onion.zwiebel"},
+		{"no onion here", ".onion.zwiebel", "no onion here"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, replaceOnion(tt.in, tt.domain))
+	}
+}
+
+func TestValidOnionAddress(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		expected bool
+	}{
+		{"duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczad", true},
+		{"DUCKDUCKGOGG42XJOC72X3SJASOWOARFBGCMVFIMAFTT6TWAGSWZCZAD", true},
+		{"", false},
+		{"duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzcza", false},
+		{"3g2upl4pq6kufc4m", false},
+		{"duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczad7", false},
+		{"duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzcza1", false},
+		{"duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzcza-", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, ValidOnionAddress(tt.name), tt.name)
+	}
+}
+
+func TestNormalizeOnion(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{"abcd.onion", "abcd"},
+		{"abcd", "abcd"},
+		{"ABCD.ONION", "abcd"},
+		{"www.abcd.onion", "abcd"},
+		{"abcd.onion:8080", "abcd"},
+		{"abcd.onion.", "abcd"},
+		{" abcd.onion ", "abcd"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, NormalizeOnion(tt.host), tt.host)
+	}
+}
+
+func TestModifyResponseCharset(t *testing.T) {
+	t.Parallel()
+
+	const link = `<a href="http://najngkjsdngsdngskjgnskjngdfg.onion/test">Gr` + "ü" + `n</a>`
+	latin1, err := charmap.ISO8859_1.NewEncoder().String(link)
+	require.NoError(t, err)
+	utf16, err := unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM).NewEncoder().String(link)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name                string
+		domain              string
+		contentType         string
+		body                string
+		expectedContentType string
+		decoder             *encoding.Decoder
+	}{
+		{"utf-8", "xxx.zwiebel", "text/html; charset=utf-8", link, "text/html; charset=utf-8", unicode.UTF8.NewDecoder()},
+		{"latin1", "xxx.zwiebel", "text/html; charset=iso-8859-1", latin1, "text/html; charset=iso-8859-1", charmap.ISO8859_1.NewDecoder()},
+		{"utf-16", "xxx.zwiebel", "text/html; charset=utf-16le", utf16, "text/html; charset=utf-16le", unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM).NewDecoder()},
+		{"unknown charset", "xxx.zwiebel", "text/html; charset=unknown", link, "text/html; charset=unknown", unicode.UTF8.NewDecoder()},
+		{"idn not in charset", "例え.jp", "text/html; charset=iso-8859-1", latin1, "text/html; charset=utf-8", unicode.UTF8.NewDecoder()},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			resp := http.Response{
+				StatusCode: 200,
+				Request: &http.Request{
+					URL: &url.URL{},
+				},
+				Header: make(http.Header),
+				Body:   io.NopCloser(bytes.NewBufferString(tt.body)),
+			}
+			resp.Header.Set("Content-Type", tt.contentType)
+
+			tor := Tor{
+				domain: tt.domain,
+				logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+			}
+			require.NoError(t, tor.ModifyResponse(&resp))
+			require.Equal(t, tt.expectedContentType, resp.Header.Get("Content-Type"))
+			modifiedBody, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			decoded, err := tt.decoder.Bytes(modifiedBody)
+			require.NoError(t, err)
+			require.Equal(t, `<a href="http://najngkjsdngsdngskjgnskjngdfg.`+tt.domain+`/test">Gr`+"ü"+`n</a>`, string(decoded))
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/firefart/zwiebelproxy/internal/tor"
+	"golang.org/x/net/http2"
+)
+
+// Options configures the transport used to connect to onion services
+type Options struct {
+	// ProxyURL is the SOCKS5 url of the tor proxy
+	ProxyURL *url.URL
+	// Timeout is used for dialing, the TLS handshake and waiting for response headers
+	Timeout time.Duration
+	// KeepAlive is the interval of TCP keep-alive probes, negative values disable them
+	KeepAlive time.Duration
+	// OnionConnectTimeout limits the time to connect to onion services, 0 means only Timeout is used
+	OnionConnectTimeout time.Duration
+	// IdleConnTimeout is the maximum amount of time an idle connection is kept open
+	IdleConnTimeout time.Duration
+	// VerifyTLS enables the verification of certificates presented by onion services
+	VerifyTLS bool
+	// VerifyTLSHosts overrides VerifyTLS for single hosts
+	VerifyTLSHosts map[string]bool
+	// IsolateRequests uses a separate tor circuit for the connections of each request
+	// carrying an isolation token. Connections are not reused between requests then.
+	IsolateRequests bool
+	// HTTP2 negotiates HTTP/2 with onion services supporting it, so multiple
+	// requests are multiplexed over a single tor stream
+	HTTP2 bool
+	// RootCAs are used to verify certificates, nil means the system roots
+	RootCAs *x509.CertPool
+}
+
+// NewTorTransport creates a transport sending all requests through the tor proxy
+func NewTorTransport(opts Options) (*http.Transport, error) {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	// the proxy is handled by the dialer so hostnames are resolved by tor
+	tr.Proxy = nil
+	// most onions use self signed certificates so verification is done
+	// manually for the hosts where it is enabled
+	tr.TLSClientConfig = &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			verify, ok := opts.VerifyTLSHosts[strings.ToLower(cs.ServerName)]
+			if !ok {
+				verify = opts.VerifyTLS
+			}
+			if !verify {
+				return nil
+			}
+			return verifyCertificate(cs, opts.RootCAs)
+		},
+	}
+	tr.TLSHandshakeTimeout = opts.Timeout
+	tr.ExpectContinueTimeout = opts.Timeout
+	tr.ResponseHeaderTimeout = opts.Timeout
+	// close idle connections early so broken circuits are not reused
+	tr.IdleConnTimeout = opts.IdleConnTimeout
+	// the cloned default transport would attempt HTTP/2 despite the custom dialer
+	tr.ForceAttemptHTTP2 = opts.HTTP2
+
+	newDialContext := tor.NewProxyDialContext
+	if opts.IsolateRequests {
+		newDialContext = tor.NewIsolatingProxyDialContext
+		// pooled connections would share the circuit of the request they were dialed for
+		tr.DisableKeepAlives = true
+	}
+	dial, err := newDialContext(opts.ProxyURL, tor.NewDialer(opts.Timeout, opts.KeepAlive))
+	if err != nil {
+		return nil, err
+	}
+	tr.DialContext = tor.WithOnionConnectTimeout(dial, opts.OnionConnectTimeout)
+
+	if opts.HTTP2 {
+		// ALPN is negotiated in the TLS handshake which is done on top of
+		// the connection through the SOCKS proxy
+		if err := http2.ConfigureTransport(tr); err != nil {
+			return nil, fmt.Errorf("could not configure http2: %w", err)
+		}
+	}
+
+	return tr, nil
+}
+
+func verifyCertificate(cs tls.ConnectionState, roots *x509.CertPool) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("no certificate presented by %s", cs.ServerName)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       cs.ServerName,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	return err
+}
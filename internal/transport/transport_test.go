@@ -0,0 +1,181 @@
+package transport
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTorTransport(t *testing.T) {
+	t.Parallel()
+
+	// fake tor proxy, only accepting the connection is checked
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	accepted := make(chan struct{})
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		close(accepted)
+		conn.Close()
+	}()
+
+	tr, err := NewTorTransport(Options{
+		ProxyURL:        &url.URL{Scheme: "socks5h", Host: l.Addr().String()},
+		Timeout:         5 * time.Second,
+		KeepAlive:       15 * time.Second,
+		IdleConnTimeout: 30 * time.Second,
+	})
+	require.NoError(t, err)
+
+	// the proxy is used by the dialer and not by the transport
+	require.Nil(t, tr.Proxy)
+	require.NotNil(t, tr.TLSClientConfig)
+	require.True(t, tr.TLSClientConfig.InsecureSkipVerify)
+	require.Equal(t, 5*time.Second, tr.TLSHandshakeTimeout)
+	require.Equal(t, 5*time.Second, tr.ExpectContinueTimeout)
+	require.Equal(t, 5*time.Second, tr.ResponseHeaderTimeout)
+	require.Equal(t, 30*time.Second, tr.IdleConnTimeout)
+
+	// connections are made to the proxy
+	require.NotNil(t, tr.DialContext)
+	_, _ = tr.DialContext(context.Background(), "tcp", "najngkjsdngsdngskjgnskjngdfg.onion:80")
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxy was not dialed")
+	}
+}
+
+func TestNewTorTransportIsolateRequests(t *testing.T) {
+	t.Parallel()
+
+	tr, err := NewTorTransport(Options{
+		ProxyURL:        &url.URL{Scheme: "socks5h", Host: "127.0.0.1:9050"},
+		Timeout:         5 * time.Second,
+		IsolateRequests: true,
+	})
+	require.NoError(t, err)
+	require.True(t, tr.DisableKeepAlives)
+	require.NotNil(t, tr.DialContext)
+}
+
+func TestNewTorTransportInvalidProxy(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewTorTransport(Options{
+		ProxyURL: &url.URL{Scheme: "http", Host: "127.0.0.1:8080"},
+		Timeout:  5 * time.Second,
+	})
+	require.Error(t, err)
+}
+
+func TestNewTorTransportHTTP2(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	for _, enabled := range []bool{true, false} {
+		t.Run(fmt.Sprint(enabled), func(t *testing.T) {
+			tr, err := NewTorTransport(Options{
+				ProxyURL: &url.URL{Scheme: "socks5h", Host: "127.0.0.1:9050"},
+				Timeout:  5 * time.Second,
+				HTTP2:    enabled,
+			})
+			require.NoError(t, err)
+			require.Equal(t, enabled, tr.ForceAttemptHTTP2)
+			// connect to the test server instead of the proxy
+			tr.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, srv.Listener.Addr().String())
+			}
+			defer tr.CloseIdleConnections()
+
+			req, err := http.NewRequest(http.MethodGet, "https://foo.onion/", nil)
+			require.NoError(t, err)
+			resp, err := tr.RoundTrip(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			if enabled {
+				require.Equal(t, 2, resp.ProtoMajor)
+			} else {
+				require.Equal(t, 1, resp.ProtoMajor)
+			}
+		})
+	}
+}
+
+func TestNewTorTransportVerifyTLS(t *testing.T) {
+	t.Parallel()
+
+	// the certificate of the test server is valid for example.com
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	tests := []struct {
+		name        string
+		host        string
+		verifyTLS   bool
+		verifyHosts map[string]bool
+		roots       *x509.CertPool
+		expectError bool
+	}{
+		{"disabled invalid cert", "foo.onion", false, nil, nil, false},
+		{"valid cert", "example.com", true, nil, roots, false},
+		{"unknown authority", "example.com", true, nil, nil, true},
+		{"invalid host", "foo.onion", true, nil, roots, true},
+		{"host override disabled", "foo.onion", true, map[string]bool{"foo.onion": false}, roots, false},
+		{"host override enabled", "foo.onion", false, map[string]bool{"foo.onion": true}, roots, true},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			tr, err := NewTorTransport(Options{
+				ProxyURL:       &url.URL{Scheme: "socks5h", Host: "127.0.0.1:9050"},
+				Timeout:        5 * time.Second,
+				VerifyTLS:      tt.verifyTLS,
+				VerifyTLSHosts: tt.verifyHosts,
+				RootCAs:        tt.roots,
+			})
+			require.NoError(t, err)
+			// connect to the test server instead of the proxy
+			tr.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, srv.Listener.Addr().String())
+			}
+			defer tr.CloseIdleConnections()
+
+			req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("https://%s/", tt.host), nil)
+			require.NoError(t, err)
+			resp, err := tr.RoundTrip(req)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/firefart/zwiebelproxy/internal/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetMaxProcsDisabled(t *testing.T) {
+	// modifies the global GOMAXPROCS so do not run in parallel
+	prev := runtime.GOMAXPROCS(3)
+	defer runtime.GOMAXPROCS(prev)
+
+	undo, err := setMaxProcs(slog.New(slog.NewTextHandler(io.Discard, nil)), true)
+	require.NoError(t, err)
+	require.Equal(t, 3, runtime.GOMAXPROCS(0))
+	undo()
+	require.Equal(t, 3, runtime.GOMAXPROCS(0))
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := `domain: onion.zwiebel
+http-port: "8000"
+debug: true
+timeout: 1m
+allowed-ip-ranges:
+  - 10.0.0.0/8
+  - 192.168.0.0/16
+blacklisted-words: foo,bar
+`
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	opts := newCLIOptions(fs)
+	// explicit flags override the file
+	require.NoError(t, fs.Parse([]string{"-http-port", "8080"}))
+	require.NoError(t, loadConfigFile(fs, path))
+
+	require.Equal(t, "onion.zwiebel", *opts.domain)
+	require.Equal(t, "8080", *opts.httpPort)
+	require.True(t, *opts.debug)
+	require.Equal(t, 1*time.Minute, *opts.timeout)
+	require.Equal(t, "10.0.0.0/8,192.168.0.0/16", *opts.allowedIPRangesRaw)
+	require.Equal(t, "foo,bar", *opts.blacklistedWords)
+	// not configured values keep their defaults
+	require.Equal(t, "443", *opts.httpsPort)
+}
+
+func TestTorIdleTimeout(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		args     []string
+		expected time.Duration
+	}{
+		{"default", nil, 90 * time.Second},
+		{"idle conn timeout", []string{"-idle-conn-timeout", "10s"}, 10 * time.Second},
+		{"alias", []string{"-tor-idle-timeout", "15s"}, 15 * time.Second},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			opts := newCLIOptions(fs)
+			require.NoError(t, fs.Parse(tt.args))
+
+			tr, err := transport.NewTorTransport(transport.Options{
+				ProxyURL:        &url.URL{Scheme: "socks5h", Host: "127.0.0.1:9050"},
+				Timeout:         *opts.timeout,
+				IdleConnTimeout: *opts.idleConnTimeout,
+			})
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, tr.IdleConnTimeout)
+		})
+	}
+}
+
+func TestLoadConfigFileInvalid(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		content string
+		key     string
+	}{
+		{"missing domain", "http-port: 8080\n", "domain"},
+		{"invalid range", "domain: onion.zwiebel\nallowed-ip-ranges: [10.0.0.0/8, 10.0.0.1]\n", "allowed-ip-ranges"},
+		{"unknown key", "domain: onion.zwiebel\nfoo: bar\n", "foo"},
+		{"invalid value", "domain: onion.zwiebel\ndebug: maybe\n", "debug"},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			require.NoError(t, os.WriteFile(path, []byte(tt.content), 0o600))
+
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			newCLIOptions(fs)
+			require.NoError(t, fs.Parse(nil))
+			err := loadConfigFile(fs, path)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tt.key)
+		})
+	}
+}